@@ -0,0 +1,116 @@
+package bcnotify
+
+import "os"
+
+// FileType is a set of kinds of file for AttrFilter.
+type FileType uint32
+
+// These are the kinds of file that AttrFilter can tell apart.
+const (
+	Regular FileType = 1 << iota
+	Dir
+	Symlink
+	FIFO
+	Socket
+	Device
+
+	AllTypes = Regular | Dir | Symlink | FIFO | Socket | Device
+)
+
+// fileType returns the kind of file mode describes.
+func fileType(mode os.FileMode) FileType {
+	switch {
+	case mode&os.ModeDir != 0:
+		return Dir
+	case mode&os.ModeSymlink != 0:
+		return Symlink
+	case mode&os.ModeNamedPipe != 0:
+		return FIFO
+	case mode&os.ModeSocket != 0:
+		return Socket
+	case mode&os.ModeDevice != 0:
+		return Device
+	case mode.IsRegular():
+		return Regular
+	}
+	return 0
+}
+
+// AttrFilter is a Filter on the attributes of the file an event is for. The
+// file is looked at with os.Lstat when the event is filtered, so symlinks are
+// not followed. Fields left at their zero value do not filter anything, so
+// files that are not empty are:
+//
+//	bcnotify.AttrFilter{MinSize: 1}
+//
+// and executable files are:
+//
+//	bcnotify.AttrFilter{Types: bcnotify.Regular, AnyPerm: 0111}
+type AttrFilter struct {
+	// Types are the kinds of file to match. Every kind matches if it is zero.
+	Types FileType
+
+	// MinSize and MaxSize are the smallest and largest sizes in bytes to
+	// match. There is no largest size if MaxSize is zero.
+	MinSize int64
+	MaxSize int64
+
+	// Perm are permission bits that must all be set, and AnyPerm are
+	// permission bits of which at least one must be set.
+	Perm    os.FileMode
+	AnyPerm os.FileMode
+
+	// UIDs and GIDs list the owners and groups to match. Any owner or group
+	// matches if they are empty. Files never match them on systems without
+	// numeric owners, such as Windows.
+	UIDs []int
+	GIDs []int
+
+	// Missing is whether to match when the file is already gone by the time
+	// the event is filtered, which is always the case for Remove and Rename.
+	Missing bool
+}
+
+// Match returns whether the file e is for has the attributes in a.
+func (a AttrFilter) Match(e *Event) bool {
+	info, err := os.Lstat(e.Name)
+	if err != nil {
+		return a.Missing
+	}
+	return a.matchInfo(info)
+}
+
+// matchInfo returns whether info has the attributes in a.
+func (a AttrFilter) matchInfo(info os.FileInfo) bool {
+	if a.Types != 0 && a.Types&fileType(info.Mode()) == 0 {
+		return false
+	}
+	if info.Size() < a.MinSize || (a.MaxSize > 0 && info.Size() > a.MaxSize) {
+		return false
+	}
+	perm := info.Mode().Perm()
+	if perm&a.Perm != a.Perm {
+		return false
+	}
+	if a.AnyPerm != 0 && perm&a.AnyPerm == 0 {
+		return false
+	}
+	if len(a.UIDs) == 0 && len(a.GIDs) == 0 {
+		return true
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return false
+	}
+	return (len(a.UIDs) == 0 || containsInt(a.UIDs, uid)) && (len(a.GIDs) == 0 || containsInt(a.GIDs, gid))
+}
+
+// containsInt returns whether n is one of list.
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package bcnotify
+
+import "os"
+
+// fileOwner returns false, since files have no numeric owner here.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
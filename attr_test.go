@@ -0,0 +1,91 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type attrTest struct {
+	filter AttrFilter
+	name   string
+	match  bool
+}
+
+// Make sure AttrFilter checks each attribute of the file.
+func TestAttrFilter(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty")
+	ioutil.WriteFile(empty, nil, 0600)
+	script := filepath.Join(dir, "script.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0700)
+	link := filepath.Join(dir, "link")
+	os.Symlink("script.sh", link)
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0700)
+
+	tests := []attrTest{
+		{AttrFilter{}, empty, true},
+		{AttrFilter{Types: Regular}, script, true},
+		{AttrFilter{Types: Regular}, sub, false},
+		{AttrFilter{Types: Dir | Symlink}, sub, true},
+		{AttrFilter{Types: Symlink}, link, true},
+		{AttrFilter{Types: Regular}, link, false},
+		{AttrFilter{MinSize: 1}, empty, false},
+		{AttrFilter{MinSize: 1}, script, true},
+		{AttrFilter{MaxSize: 5}, script, false},
+		{AttrFilter{AnyPerm: 0111}, script, true},
+		{AttrFilter{AnyPerm: 0111}, empty, false},
+		{AttrFilter{Perm: 0700}, script, true},
+		{AttrFilter{Perm: 0700}, empty, false},
+		{AttrFilter{}, filepath.Join(dir, "missing"), false},
+		{AttrFilter{Missing: true}, filepath.Join(dir, "missing"), true},
+	}
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		tests = append(tests,
+			attrTest{AttrFilter{UIDs: []int{os.Getuid()}, GIDs: []int{os.Getgid()}}, empty, true},
+			attrTest{AttrFilter{UIDs: []int{os.Getuid() + 1}}, empty, false},
+		)
+	}
+	for _, test := range tests {
+		if test.filter.Match(&Event{Name: test.name}) != test.match {
+			t.Fatalf("%+v.Match(%q) should be %v", test.filter, test.name, test.match)
+		}
+	}
+}
+
+// Make sure an AttrFilter given to AddDirOptions drops events for files that
+// do not have the attributes.
+func TestAddDirOptionsAttrFilter(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDirOptions(dir, DirOptions{
+		Filter: AttrFilter{Types: Regular, MinSize: 1},
+		Ops:    Create,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file that has the attributes comes last, so the others must have
+	// been filtered out if it is the first event delivered.
+	sub := filepath.Join(dir, "sub")
+	empty := filepath.Join(dir, "empty")
+	want := filepath.Join(dir, "full")
+	os.Mkdir(sub, 0700)
+	ioutil.WriteFile(empty, nil, 0600)
+	ioutil.WriteFile(want, []byte("test"), 0600)
+	send(b, Event{Name: sub, Op: Create}, Event{Name: empty, Op: Create}, Event{Name: want, Op: Create})
+
+	if event := waitEvent(t, fw); event.Name != want {
+		t.Error("Notified of wrong file:", event)
+	}
+}
@@ -0,0 +1,109 @@
+package bcnotify
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Backend is the source of the raw events that a FileSystemWatcher filters,
+// recurses into directories for and hands on. It only needs to watch single
+// paths, reporting the changes to a watched file, or to the entries of a
+// watched directory, in the same way as fsnotify:
+//
+//   - Create, Write, Remove and Chmod for the entries of a directory.
+//   - Rename for an entry renamed away, followed straight away by Create for
+//     its new name if that is in a watched directory.
+//   - Remove or Rename for a watched path itself when it goes.
+//
+// Only Name and Op need to be set on the events sent.
+type Backend interface {
+	// Add starts watching path.
+	Add(path string) error
+
+	// Remove stops watching path.
+	Remove(path string) error
+
+	// Events returns the channel that events are sent on. It is closed once
+	// the Backend is closed.
+	Events() <-chan Event
+
+	// Errors returns the channel that errors are sent on. It is closed once
+	// the Backend is closed.
+	Errors() <-chan error
+
+	// Close stops watching everything.
+	Close() error
+}
+
+// WithBackend makes the FileSystemWatcher use b in place of fsnotify. The
+// FileSystemWatcher closes b when it is closed.
+func WithBackend(b Backend) Option {
+	return func(fw *FileSystemWatcher) {
+		fw.watcher = b
+	}
+}
+
+// fsnotifyBackend is the Backend that uses fsnotify, which is the default.
+type fsnotifyBackend struct {
+	w      *fsnotify.Watcher
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewFSNotifyBackend returns a Backend that is notified of changes by the
+// operating system through fsnotify. It is what a FileSystemWatcher uses
+// unless it is given another with WithBackend.
+func NewFSNotifyBackend() (Backend, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	b := &fsnotifyBackend{w: w, events: make(chan Event), done: make(chan struct{})}
+	go func() {
+		defer close(b.events)
+		for event := range w.Events {
+			select {
+			case b.events <- Event{Name: event.Name, Op: Op(event.Op)}:
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return b, nil
+}
+
+func (b *fsnotifyBackend) Add(path string) error    { return b.w.Add(path) }
+func (b *fsnotifyBackend) Remove(path string) error { return b.w.Remove(path) }
+func (b *fsnotifyBackend) Events() <-chan Event     { return b.events }
+func (b *fsnotifyBackend) Errors() <-chan error     { return b.w.Errors }
+
+func (b *fsnotifyBackend) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return b.w.Close()
+}
+
+// pollingBackend is a Backend that polls every path at the same interval.
+type pollingBackend struct {
+	*poller
+	interval time.Duration
+}
+
+// NewPollingBackend returns a Backend that finds changes by looking at every
+// watched path once per interval. See WithPolling.
+func NewPollingBackend(interval time.Duration) Backend {
+	return &pollingBackend{poller: newPoller(), interval: interval}
+}
+
+// Add starts polling path.
+func (b *pollingBackend) Add(path string) error {
+	return b.poller.Add(path, b.interval)
+}
+
+// rawEvent turns an event from a Backend into the form used inside the
+// FileSystemWatcher.
+func rawEvent(e Event) fsnotify.Event {
+	return fsnotify.Event{Name: e.Name, Op: fsnotify.Op(e.Op)}
+}
@@ -0,0 +1,66 @@
+package bcnotify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure a FileSystemWatcher uses the Backend it is given for everything.
+func TestWithBackend(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+
+	b := NewFakeBackend()
+	fw, err := NewFileSystemWatcher(WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	if err := fw.AddDir(dir, "*.txt", Create, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, filepath.Join(dir, "sub")} {
+		if !b.Watching(path) {
+			t.Fatal("Backend is not watching", path)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		event, err := fw.WaitEvent()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if event.Name != filepath.Join(dir, "sub", "test.txt") || event.Op != Create {
+			t.Error("Got the wrong event:", event)
+		}
+	}()
+
+	// Filtered out by the pattern and the Op.
+	b.Send(filepath.Join(dir, "test.log"), Create)
+	b.Send(filepath.Join(dir, "test.txt"), Write)
+	b.Send(filepath.Join(dir, "sub", "test.txt"), Create)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	if err := fw.RemoveDir(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if b.Watching(dir) || b.Watching(filepath.Join(dir, "sub")) {
+		t.Fatal("Backend is still watching after RemoveDir")
+	}
+
+	fw.Close()
+	if _, ok := <-b.Events(); ok {
+		t.Fatal("Backend was not closed with the watcher")
+	}
+}
@@ -0,0 +1,112 @@
+package bcnotify
+
+import (
+	"context"
+	"time"
+)
+
+// NotifyBatch collects events until the file system has been quiet for the
+// quiet duration and then calls notify with all of them at once. This suits
+// tools that want to act once a tree has settled, such as rebuilding after a
+// checkout.
+//
+// If maxLatency is greater than zero, a batch is delivered once its first event
+// is that old even if events are still arriving.
+//
+// Events for the same path are merged into one, in the position of the first
+// of them, with the Op of each merged in. Errors are passed on straight away
+// with a nil batch.
+func (fw *FileSystemWatcher) NotifyBatch(quiet, maxLatency time.Duration, notify func([]*Event, error)) {
+	fw.NotifyBatchContext(context.Background(), quiet, maxLatency, notify)
+}
+
+// NotifyBatchContext is like NotifyBatch, but stops once ctx is done or the
+// returned stop function is called, as NotifyEventContext does. A batch still
+// being collected then is dropped.
+func (fw *FileSystemWatcher) NotifyBatchContext(ctx context.Context, quiet, maxLatency time.Duration, notify func([]*Event, error)) (stop func()) {
+	ctx, cancelCtx := context.WithCancel(ctx)
+	results, cancel := fw.readEvents(ctx)
+	stop = func() {
+		cancelCtx()
+		cancel()
+	}
+	go func() {
+		var batch []*Event
+		index := make(map[string]*Event)
+
+		// quietTimer fires once nothing has arrived for the quiet duration and
+		// latest fires once the batch is maxLatency old. Both are nil while
+		// there is no batch.
+		var quietTimer *time.Timer
+		var quietC, latest <-chan time.Time
+
+		deliver := func() {
+			if quietTimer != nil {
+				quietTimer.Stop()
+			}
+			quietTimer, quietC, latest = nil, nil, nil
+			if len(batch) == 0 {
+				return
+			}
+			notify(batch, nil)
+			batch = nil
+			index = make(map[string]*Event)
+		}
+
+		defer func() {
+			if quietTimer != nil {
+				quietTimer.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case r, ok := <-results:
+				if !ok {
+					if ctx.Err() == nil {
+						deliver()
+					}
+					return
+				}
+				// Stopping may race with an event on its way.
+				if ctx.Err() != nil {
+					return
+				}
+				if r.err != nil {
+					notify(nil, r.err)
+					continue
+				}
+				if e, ok := index[r.event.Name]; ok {
+					e.Op |= r.event.Op
+				} else {
+					index[r.event.Name] = r.event
+					batch = append(batch, r.event)
+				}
+
+				if quietTimer == nil {
+					quietTimer = time.NewTimer(quiet)
+					quietC = quietTimer.C
+					if maxLatency > 0 {
+						latest = time.After(maxLatency)
+					}
+					continue
+				}
+				if !quietTimer.Stop() {
+					select {
+					case <-quietTimer.C:
+					default:
+					}
+				}
+				quietTimer.Reset(quiet)
+			case <-quietC:
+				quietTimer = nil
+				deliver()
+			case <-latest:
+				deliver()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,160 @@
+package bcnotify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure NotifyBatch waits for things to settle and merges events for the
+// same path.
+func TestNotifyBatch(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create|Write, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	batches := make(chan []*Event, 10)
+	fw.NotifyBatch(50*time.Millisecond, 0, func(events []*Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		batches <- events
+	})
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		filename := filepath.Join(dir, fmt.Sprintf("test%d.txt", i))
+		names = append(names, filename)
+		ioutil.WriteFile(filename, []byte("test"), 0700)
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Write the first file again, which should not change the order.
+	ioutil.WriteFile(names[0], []byte("test"), 0700)
+
+	select {
+	case batch := <-batches:
+		if len(batch) != len(names) {
+			t.Fatalf("Wanted %d events got %d: %v", len(names), len(batch), batch)
+		}
+		for i, event := range batch {
+			if event.Name != names[i] {
+				t.Fatalf("Wanted %s got %s", names[i], event.Name)
+			}
+			if event.Op != Create|Write {
+				t.Fatal("Events were not merged:", event)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+// Make sure a batch is delivered after maxLatency even if events keep coming.
+func TestNotifyBatchMaxLatency(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	batches := make(chan []*Event, 10)
+	fw.NotifyBatch(100*time.Millisecond, 150*time.Millisecond, func(events []*Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		batches <- events
+	})
+
+	// Never stay quiet for long enough.
+	start := time.Now()
+	stop := time.After(500 * time.Millisecond)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("test%d.txt", i)), []byte("test"), 0700)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-batches:
+		if time.Since(start) > 400*time.Millisecond {
+			t.Fatal("Batch was delivered too late")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+// Make sure NotifyBatchContext drops the batch being collected once it is
+// stopped.
+func TestNotifyBatchContext(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := make(chan []*Event, 10)
+	stop := fw.NotifyBatchContext(context.Background(), 20*time.Millisecond, 0, func(events []*Event, err error) {
+		batches <- events
+	})
+
+	filename := filepath.Join(dir, "test.txt")
+	send(b, Event{Name: filename, Op: Create})
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 || batch[0].Name != filename {
+			t.Fatal("Got the wrong batch:", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	// The batch is still collecting this when stop is called.
+	b.Send(filename, Write)
+	stop()
+	other := filepath.Join(dir, "other.txt")
+	send(b, Event{Name: other, Op: Create})
+	// The Write may not have reached the batch before stop, in which case it
+	// is handed back to WaitEvent.
+	event := waitEvent(t, fw)
+	if event.Name == filename && event.Op == Write {
+		event = waitEvent(t, fw)
+	}
+	if event.Name != other {
+		t.Fatal("Got the wrong event:", event)
+	}
+	select {
+	case batch := <-batches:
+		t.Fatal("notify was called after stop:", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,173 @@
+package bcnotify
+
+import (
+	"context"
+	"time"
+)
+
+// Edge selects when NotifyDebounced delivers the events for a path.
+type Edge int
+
+const (
+	// TrailingEdge delivers one event once a path has been quiet for the
+	// window, with the Op of every event seen for it in the meantime.
+	TrailingEdge Edge = iota
+
+	// LeadingEdge delivers the first event for a path straight away and drops
+	// everything after it until the path has been quiet for the window.
+	LeadingEdge
+)
+
+// eventResult is an event or error read from WaitEvent.
+type eventResult struct {
+	event *Event
+	err   error
+}
+
+// readEvents subscribes to every event and error and sends them on the
+// returned channel, which is closed once the watcher is closed or ctx is done.
+// The subscription is cancelled once ctx is done, or straight away by the
+// returned function.
+func (fw *FileSystemWatcher) readEvents(ctx context.Context) (<-chan eventResult, func()) {
+	results := make(chan eventResult)
+	events, errs, cancel := fw.Subscribe(nil)
+	go func() {
+		defer close(results)
+		defer cancel()
+		for {
+			var r eventResult
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				r.event = &event
+			case err, ok := <-errs:
+				if !ok {
+					return
+				}
+				r.err = err
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results, cancel
+}
+
+// debounced is the state kept for a path that has had an event within the
+// quiet window.
+type debounced struct {
+	event    *Event    // Event to deliver, with the Op of every event merged in
+	deadline time.Time // When the path will have been quiet for the window
+}
+
+// NotifyDebounced is like NotifyEvent, but coalesces the events for each path
+// that arrive within window of each other. Editors and build tools tend to
+// send several events for a single save, so this calls notify once per save
+// rather than once per event. Errors are passed on straight away.
+func (fw *FileSystemWatcher) NotifyDebounced(window time.Duration, edge Edge, notify func(*Event, error)) {
+	fw.NotifyDebouncedContext(context.Background(), window, edge, notify)
+}
+
+// NotifyDebouncedContext is like NotifyDebounced, but stops once ctx is done
+// or the returned stop function is called, as NotifyEventContext does. Events
+// still waiting for their path to go quiet then are dropped.
+func (fw *FileSystemWatcher) NotifyDebouncedContext(ctx context.Context, window time.Duration, edge Edge, notify func(*Event, error)) (stop func()) {
+	ctx, cancelCtx := context.WithCancel(ctx)
+	results, cancel := fw.readEvents(ctx)
+	stop = func() {
+		cancelCtx()
+		cancel()
+	}
+	go func() {
+		paths := make(map[string]*debounced)
+		// order keeps the paths in the order their first event arrived, so
+		// paths that go quiet together are delivered in that order.
+		var order []string
+
+		timer := time.NewTimer(window)
+		timer.Stop()
+		defer timer.Stop()
+
+		for {
+			select {
+			case r, ok := <-results:
+				if !ok {
+					if ctx.Err() != nil {
+						return
+					}
+					// Deliver anything still waiting before giving up.
+					if edge == TrailingEdge {
+						for _, name := range order {
+							notify(paths[name].event, nil)
+						}
+					}
+					return
+				}
+				// Stopping may race with an event on its way.
+				if ctx.Err() != nil {
+					return
+				}
+				if r.err != nil {
+					notify(nil, r.err)
+					continue
+				}
+				deadline := time.Now().Add(window)
+				if d, ok := paths[r.event.Name]; ok {
+					d.event.Op |= r.event.Op
+					d.deadline = deadline
+					continue
+				}
+				// Keep our own copy to merge into, since with LeadingEdge the
+				// event is handed to notify below.
+				e := *r.event
+				paths[r.event.Name] = &debounced{event: &e, deadline: deadline}
+				order = append(order, r.event.Name)
+				if edge == LeadingEdge {
+					notify(r.event, nil)
+				}
+			case <-timer.C:
+			case <-ctx.Done():
+				return
+			}
+
+			// Deliver the paths that have gone quiet and work out when the next
+			// one will.
+			now := time.Now()
+			var next time.Time
+			waiting := order[:0]
+			for _, name := range order {
+				d := paths[name]
+				if !now.Before(d.deadline) {
+					delete(paths, name)
+					if edge == TrailingEdge {
+						notify(d.event, nil)
+					}
+					continue
+				}
+				if next.IsZero() || d.deadline.Before(next) {
+					next = d.deadline
+				}
+				waiting = append(waiting, name)
+			}
+			order = waiting
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if !next.IsZero() {
+				timer.Reset(next.Sub(now))
+			}
+		}
+	}()
+	return stop
+}
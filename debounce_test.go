@@ -0,0 +1,174 @@
+package bcnotify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Save a file the way an editor might, with several events in a row.
+func saveFile(t *testing.T, filename string) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("test")
+	f.Sync()
+	time.Sleep(5 * time.Millisecond)
+	f.WriteString("test")
+	f.Close()
+	time.Sleep(5 * time.Millisecond)
+	os.Chmod(filename, 0600)
+}
+
+// Make sure TrailingEdge delivers a single event with every Op merged in.
+func TestNotifyDebouncedTrailing(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyDebounced(50*time.Millisecond, TrailingEdge, func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	filename := filepath.Join(dir, "test.txt")
+	other := filepath.Join(dir, "other.txt")
+	saveFile(t, filename)
+	ioutil.WriteFile(other, []byte("test"), 0700)
+
+	got := map[string]Op{}
+	timeout := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case event := <-events:
+			if _, ok := got[event.Name]; ok {
+				t.Fatal("Got a second event for", event.Name)
+			}
+			got[event.Name] = event.Op
+		case <-timeout:
+			t.Fatal("Timed out with", got)
+		}
+	}
+	if want := Create | Write | Chmod; got[filename] != want {
+		t.Fatalf("Wanted %s got %s", want, got[filename])
+	}
+	if want := Create | Write; got[other] != want {
+		t.Fatalf("Wanted %s got %s", want, got[other])
+	}
+
+	select {
+	case event := <-events:
+		t.Fatal("Got an extra event:", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Make sure LeadingEdge delivers the first event straight away and drops the
+// rest until the path goes quiet.
+func TestNotifyDebouncedLeading(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyDebounced(50*time.Millisecond, LeadingEdge, func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	filename := filepath.Join(dir, "test.txt")
+	saveFile(t, filename)
+
+	select {
+	case event := <-events:
+		if event.Op != Create {
+			t.Fatal("Wanted the Create event first, got", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	select {
+	case event := <-events:
+		t.Fatal("Got an extra event:", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the window has passed the next save is delivered again.
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	select {
+	case event := <-events:
+		if event.Name != filename {
+			t.Fatal("Got the wrong event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+// Make sure NotifyDebouncedContext stops calling notify once it is stopped.
+func TestNotifyDebouncedContext(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 10)
+	stop := fw.NotifyDebouncedContext(context.Background(), 20*time.Millisecond, TrailingEdge, func(event *Event, err error) {
+		events <- event
+	})
+
+	filename := filepath.Join(dir, "test.txt")
+	send(b, Event{Name: filename, Op: Create}, Event{Name: filename, Op: Write})
+	select {
+	case event := <-events:
+		if event == nil || event.Name != filename || event.Op != Create|Write {
+			t.Fatal("Got the wrong event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	stop()
+	other := filepath.Join(dir, "other.txt")
+	send(b, Event{Name: other, Op: Create})
+	if event := waitEvent(t, fw); event.Name != other {
+		t.Fatal("Got the wrong event:", event)
+	}
+	select {
+	case event := <-events:
+		t.Fatal("notify was called after stop:", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
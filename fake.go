@@ -0,0 +1,178 @@
+package bcnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// FakeBackend is a Backend for tests that sends only the events it is told to
+// send. Files and directories still have to be made on disk for the
+// FileSystemWatcher to look at, but nothing happens until the test calls
+// Send, so tests do not need to sleep and hope the operating system has caught
+// up:
+//
+//	b := bcnotify.NewFakeBackend()
+//	fw, _ := bcnotify.NewFileSystemWatcher(bcnotify.WithBackend(b))
+//	fw.AddDir(dir, "*.txt", bcnotify.AllOps, false)
+//
+//	ioutil.WriteFile(filepath.Join(dir, "test.txt"), []byte("test"), 0600)
+//	go b.Send(filepath.Join(dir, "test.txt"), bcnotify.Create)
+//	event, err := fw.WaitEvent()
+//
+// Send blocks until the FileSystemWatcher has taken the event, and the
+// FileSystemWatcher takes one event at a time, so once Send returns for an
+// event the watcher has finished with every event sent before it. To check
+// that an event is filtered out, send it followed by one that is not and
+// make sure the second is the one delivered.
+type FakeBackend struct {
+	mu      sync.Mutex
+	watched map[string]bool
+	closed  bool
+
+	events chan Event
+	errors chan error
+	done   chan struct{}
+	once   sync.Once
+	sendMu sync.RWMutex // held for reading while sending, so Close waits
+}
+
+// NewFakeBackend returns a FakeBackend that is watching nothing yet.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		watched: make(map[string]bool),
+		events:  make(chan Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add starts watching path. As with fsnotify, path must exist.
+func (b *FakeBackend) Add(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		return stackerr.Wrap(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrWatcherClosed
+	}
+	b.watched[filepath.Clean(path)] = true
+	return nil
+}
+
+// Remove stops watching path. As with fsnotify, it returns an error if path
+// is not being watched.
+func (b *FakeBackend) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = filepath.Clean(path)
+	if !b.watched[path] {
+		return fmt.Errorf("Can't remove %s, which is not being watched", path)
+	}
+	delete(b.watched, path)
+	return nil
+}
+
+// Events returns the channel that events are sent on.
+func (b *FakeBackend) Events() <-chan Event {
+	return b.events
+}
+
+// Errors returns the channel that errors are sent on.
+func (b *FakeBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Close stops watching everything and closes the channels.
+func (b *FakeBackend) Close() error {
+	b.once.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		b.watched = make(map[string]bool)
+		b.mu.Unlock()
+
+		// Let anything blocked in Send or SendError give up before the
+		// channels are closed under it.
+		close(b.done)
+		b.sendMu.Lock()
+		close(b.events)
+		close(b.errors)
+		b.sendMu.Unlock()
+	})
+	return nil
+}
+
+// Watching returns whether path is being watched.
+func (b *FakeBackend) Watching(path string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.watched[filepath.Clean(path)]
+}
+
+// Watched returns every path being watched, in order.
+func (b *FakeBackend) Watched() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	paths := make([]string, 0, len(b.watched))
+	for path := range b.watched {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Send sends the event op for name, as the operating system would: only if
+// name or the directory it is in is being watched. It blocks until the
+// FileSystemWatcher has taken the event, and returns whether it was sent.
+// As with fsnotify, a watched path stops being watched once a Remove is sent
+// for it.
+func (b *FakeBackend) Send(name string, op Op) bool {
+	b.mu.Lock()
+	path := filepath.Clean(name)
+	self := b.watched[path]
+	if !self && !b.watched[filepath.Dir(path)] {
+		b.mu.Unlock()
+		return false
+	}
+	if self && op&Remove == Remove {
+		delete(b.watched, path)
+	}
+	b.mu.Unlock()
+
+	b.sendMu.RLock()
+	defer b.sendMu.RUnlock()
+	select {
+	case <-b.done:
+		return false
+	default:
+	}
+	select {
+	case b.events <- Event{Name: name, Op: op}:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
+// SendError sends err, blocking until the FileSystemWatcher has taken it. It
+// returns false if the FakeBackend was closed first.
+func (b *FakeBackend) SendError(err error) bool {
+	b.sendMu.RLock()
+	defer b.sendMu.RUnlock()
+	select {
+	case <-b.done:
+		return false
+	default:
+	}
+	select {
+	case b.errors <- err:
+		return true
+	case <-b.done:
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+package bcnotify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure a FakeBackend only watches what exists and only sends events for
+// what it is watching, as fsnotify does.
+func TestFakeBackend(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0700)
+
+	b := NewFakeBackend()
+	defer b.Close()
+
+	if err := b.Add(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Add should not allow adding of non-existing paths")
+	}
+	if err := b.Add(sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	if watched := b.Watched(); len(watched) != 2 || watched[0] != filepath.Clean(dir) || watched[1] != filepath.Clean(sub) {
+		t.Fatal("Wrong paths watched:", watched)
+	}
+
+	if b.Send(filepath.Join(sub, "deeper", "test.txt"), Create) {
+		t.Fatal("Sent an event for a path that is not watched")
+	}
+
+	received := make(chan Event, 1)
+	go func() {
+		received <- <-b.Events()
+	}()
+	if !b.Send(filepath.Join(sub, "test.txt"), Create) {
+		t.Fatal("Did not send an event for a watched directory")
+	}
+	if e := <-received; e.Name != filepath.Join(sub, "test.txt") || e.Op != Create {
+		t.Fatal("Got the wrong event:", e)
+	}
+
+	// A watched path that is removed is no longer watched.
+	go func() {
+		received <- <-b.Events()
+	}()
+	b.Send(sub, Remove)
+	<-received
+	if b.Watching(sub) {
+		t.Fatal("Still watching a removed path")
+	}
+	if err := b.Remove(sub); err == nil {
+		t.Fatal("Remove should fail for a path that is not watched")
+	}
+
+	go func() {
+		if err := <-b.Errors(); err == nil || err.Error() != "test error" {
+			t.Error("Got the wrong error:", err)
+		}
+		close(received)
+	}()
+	if !b.SendError(errors.New("test error")) {
+		t.Fatal("Did not send the error")
+	}
+	<-received
+}
+
+// Make sure closing a FakeBackend lets go of anything waiting to send.
+func TestFakeBackendClose(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b := NewFakeBackend()
+	if err := b.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan bool)
+	go func() {
+		sent <- b.Send(filepath.Join(dir, "test.txt"), Create)
+	}()
+	// Nothing is reading, so the Send is still waiting.
+	select {
+	case <-sent:
+		t.Fatal("Send returned before the event was taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.Close()
+	select {
+	case ok := <-sent:
+		if ok {
+			t.Fatal("Send reported an event as sent after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+	if _, ok := <-b.Events(); ok {
+		t.Fatal("Events was not closed")
+	}
+	if _, ok := <-b.Errors(); ok {
+		t.Fatal("Errors was not closed")
+	}
+	if b.Send(filepath.Join(dir, "test.txt"), Create) || b.SendError(errors.New("test error")) {
+		t.Fatal("Sent after Close")
+	}
+	if len(b.Watched()) != 0 {
+		t.Fatal("Still watching after Close:", b.Watched())
+	}
+}
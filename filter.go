@@ -0,0 +1,141 @@
+package bcnotify
+
+import (
+	"path/filepath"
+	"regexp"
+)
+
+// Filter decides which events for a directory are delivered. It is given to
+// AddDirOptions in DirOptions.Filter, and is checked after the Include and
+// Exclude patterns.
+//
+// The built in filters can be combined with And, Or and Not, so files named
+// like "report-20160102.csv" but not in the archive directory are:
+//
+//	bcnotify.And(
+//		bcnotify.Regexp(regexp.MustCompile(`(^|/)report-\d{8}\.csv$`)),
+//		bcnotify.Not(bcnotify.MustGlob("archive/**")),
+//	)
+type Filter interface {
+	// Match returns whether the event should be delivered.
+	Match(e *Event) bool
+}
+
+// FilterFunc is a function used as a Filter.
+type FilterFunc func(e *Event) bool
+
+// Match calls f(e).
+func (f FilterFunc) Match(e *Event) bool {
+	return f(e)
+}
+
+// globFilter matches a pattern the same way as the pattern given to AddDir.
+// The pattern has already been checked by Glob.
+type globFilter string
+
+// Glob returns a Filter that matches events for files that fit pattern, which
+// is matched the same way as the pattern given to AddDir. It returns an error
+// if pattern is malformed.
+func Glob(pattern string) (Filter, error) {
+	if err := checkPattern(pattern); err != nil {
+		return nil, err
+	}
+	return globFilter(pattern), nil
+}
+
+// MustGlob is like Glob but panics if pattern is malformed.
+func MustGlob(pattern string) Filter {
+	f, err := Glob(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (g globFilter) Match(e *Event) bool {
+	pattern := string(g)
+	if isPathPattern(pattern) {
+		match, err := matchGlob(pattern, e.rel())
+		return err == nil && match
+	}
+	match, err := filepath.Match(pattern, filepath.Base(e.Name))
+	return err == nil && match
+}
+
+// regexpFilter matches a regular expression against the relative path.
+type regexpFilter struct {
+	re *regexp.Regexp
+}
+
+// Regexp returns a Filter that matches events for files whose path, relative
+// to the directory that was added and with forward slashes, matches re. As
+// with re.MatchString, the match may be anywhere in the path unless re is
+// anchored.
+func Regexp(re *regexp.Regexp) Filter {
+	return regexpFilter{re: re}
+}
+
+func (r regexpFilter) Match(e *Event) bool {
+	return r.re.MatchString(e.rel())
+}
+
+// andFilter matches when every one of its filters does.
+type andFilter []Filter
+
+// And returns a Filter that matches an event if all of filters do. With no
+// filters it matches everything.
+func And(filters ...Filter) Filter {
+	return andFilter(filters)
+}
+
+func (a andFilter) Match(e *Event) bool {
+	for _, f := range a {
+		if !f.Match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// orFilter matches when any one of its filters does.
+type orFilter []Filter
+
+// Or returns a Filter that matches an event if any of filters do. With no
+// filters it matches nothing.
+func Or(filters ...Filter) Filter {
+	return orFilter(filters)
+}
+
+func (o orFilter) Match(e *Event) bool {
+	for _, f := range o {
+		if f.Match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// notFilter matches when its filter does not.
+type notFilter struct {
+	f Filter
+}
+
+// Not returns a Filter that matches an event if f does not.
+func Not(f Filter) Filter {
+	return notFilter{f: f}
+}
+
+func (n notFilter) Match(e *Event) bool {
+	return !n.f.Match(e)
+}
+
+// rel returns the path of e relative to the directory that was added, using
+// forward slashes. If that is not known, the path is returned as it is.
+func (e *Event) rel() string {
+	if e.watch != nil {
+		if rel, err := filepath.Rel(e.watch.root, e.Name); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(e.Name)
+}
@@ -0,0 +1,83 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// Make sure the built in filters and their combinations match properly.
+func TestFilters(t *testing.T) {
+	p := &watchPath{path: "root", root: "root", isdir: true}
+	report := Regexp(regexp.MustCompile(`(^|/)report-\d{8}\.csv$`))
+	archived := MustGlob("archive/**")
+	writes := FilterFunc(func(e *Event) bool { return e.Op&Write == Write })
+
+	tests := []struct {
+		filter Filter
+		name   string
+		op     Op
+		match  bool
+	}{
+		{report, "report-20160102.csv", Create, true},
+		{report, "sub/report-20160102.csv", Create, true},
+		{report, "report-2016.csv", Create, false},
+		{report, "old-report-20160102.csv", Create, false},
+		{archived, "archive/2016/report.csv", Create, true},
+		{archived, "report.csv", Create, false},
+		{MustGlob("*.csv"), "sub/report.csv", Create, true},
+		{writes, "report.csv", Write, true},
+		{writes, "report.csv", Create, false},
+		{And(report, Not(archived)), "report-20160102.csv", Create, true},
+		{And(report, Not(archived)), "archive/report-20160102.csv", Create, false},
+		{Or(archived, writes), "report.csv", Write, true},
+		{Or(archived, writes), "report.csv", Create, false},
+		{And(), "report.csv", Create, true},
+		{Or(), "report.csv", Create, false},
+	}
+	for _, test := range tests {
+		e := &Event{Name: filepath.Join("root", test.name), Op: test.op, watch: p}
+		if test.filter.Match(e) != test.match {
+			t.Fatalf("%#v.Match(%s) should be %v", test.filter, e, test.match)
+		}
+	}
+
+	if _, err := Glob("[a-"); err == nil {
+		t.Fatal("Glob should not allow malformed patterns")
+	}
+}
+
+// Make sure AddDirOptions only delivers events that match its Filter.
+func TestAddDirOptionsFilter(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDirOptions(dir, DirOptions{
+		Include: []string{"*.csv"},
+		Filter:  Regexp(regexp.MustCompile(`^report-\d{8}\.csv$`)),
+		Ops:     Create,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The match comes last, so the others must have been filtered out if it
+	// is the first event delivered.
+	want := filepath.Join(dir, "report-20160102.csv")
+	var events []Event
+	for _, name := range []string{"report-2016.csv", "report-20160102.txt", "report-20160102.csv"} {
+		name = filepath.Join(dir, name)
+		ioutil.WriteFile(name, []byte("test"), 0700)
+		events = append(events, Event{Name: name, Op: Create})
+	}
+	send(b, events...)
+
+	if event := waitEvent(t, fw); event.Name != want {
+		t.Error("Notified of wrong file:", event)
+	}
+}
@@ -0,0 +1,63 @@
+package bcnotify
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isPathPattern returns whether pattern should be matched against the path
+// relative to the watched directory rather than against the filename only.
+func isPathPattern(pattern string) bool {
+	return strings.Contains(pattern, "/") || strings.Contains(pattern, "**")
+}
+
+// matchRelative matches pattern against name relative to root.
+func matchRelative(pattern, root, name string) (bool, error) {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false, err
+	}
+	return matchGlob(pattern, filepath.ToSlash(rel))
+}
+
+// matchGlob reports whether name matches pattern. Both use forward slashes.
+// Each element of pattern between slashes is matched with path.Match, except
+// for "**", which matches any number of elements, including none. A leading
+// "/" or "./" in pattern is ignored, since it is always relative.
+func matchGlob(pattern, name string) (bool, error) {
+	pattern = strings.TrimPrefix(pattern, "./")
+	pattern = strings.TrimPrefix(pattern, "/")
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchElems does the work for matchGlob on the split pattern and name.
+func matchElems(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Collapse runs of ** and try every number of elements for it.
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true, nil
+			}
+			for i := 0; i <= len(name); i++ {
+				match, err := matchElems(pattern, name[i:])
+				if match || err != nil {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		match, err := path.Match(pattern[0], name[0])
+		if !match || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
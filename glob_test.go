@@ -0,0 +1,107 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Make sure ** patterns match the way they should.
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/main.go", true},
+		{"src/**/*.go", "main.go", false},
+		{"src/**/*.go", "src/a/main.txt", false},
+		{"docs/*/index.md", "docs/api/index.md", true},
+		{"docs/*/index.md", "docs/index.md", false},
+		{"docs/*/index.md", "docs/a/b/index.md", false},
+		{"**/*.txt", "test.txt", true},
+		{"**/*.txt", "a/b/test.txt", true},
+		{"**", "a/b", true},
+		{"a/**", "a", true},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+		{"a/**/**/c", "a/c", true},
+		{"/src/*.go", "src/main.go", true},
+		{"./src/*.go", "src/main.go", true},
+		{"src/*.go", "src/a/main.go", false},
+	}
+	for _, test := range tests {
+		match, err := matchGlob(test.pattern, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != test.match {
+			t.Fatalf("matchGlob(%q, %q) = %v, wanted %v", test.pattern, test.name, match, test.match)
+		}
+	}
+
+	if _, err := matchGlob("src/[", "src/a"); err == nil {
+		t.Fatal("matchGlob should return an error for a bad pattern")
+	}
+}
+
+// Make sure a recursive AddDir filters on the path relative to the directory
+// that was added when the pattern has a slash in it.
+func TestPathPatternFilter(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "src", "pkg"), 0700)
+	os.MkdirAll(filepath.Join(dir, "other"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "src/**/*.go", Create, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The match comes last, so the others must have been filtered out if it
+	// is the first event delivered.
+	match := filepath.Join(dir, "src", "pkg", "main.go")
+	var events []Event
+	for _, name := range []string{
+		filepath.Join(dir, "other", "main.go"),
+		filepath.Join(dir, "src", "pkg", "main.txt"),
+		match,
+	} {
+		ioutil.WriteFile(name, []byte("test"), 0700)
+		events = append(events, Event{Name: name, Op: Create})
+	}
+	send(b, events...)
+
+	if event := waitEvent(t, fw); event.Name != match {
+		t.Error("Notified of wrong file:", event)
+	}
+}
+
+// Make sure AddDir and AddDirNotify reject malformed patterns.
+func TestAddDirBadPattern(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := newFakeWatcher(t)
+	defer fw.Close()
+
+	for _, pattern := range []string{"[a-", "src/**/[a-"} {
+		if err := fw.AddDir(dir, pattern, AllOps, true); err == nil {
+			t.Fatal("AddDir should not allow malformed patterns:", pattern)
+		}
+		if err := fw.AddDirNotify(dir, pattern, AllOps, true, func(*Event, error) {}); err == nil {
+			t.Fatal("AddDirNotify should not allow malformed patterns:", pattern)
+		}
+	}
+	if fw.watchPaths.len() != 0 {
+		t.Fatal("A path was added despite failing")
+	}
+	if len(fw.handlers) != 0 {
+		t.Fatal("A handler was added despite failing")
+	}
+}
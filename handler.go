@@ -0,0 +1,102 @@
+package bcnotify
+
+import "path/filepath"
+
+// AddFileNotify is like AddFile, but notify is called with the events for
+// this file alone, along with every error. Events for the file are still
+// delivered to WaitEvent and any subscribers as usual.
+// The handler is dropped when the file is removed with RemoveFile.
+func (fw *FileSystemWatcher) AddFileNotify(path string, ops Op, notify func(*Event, error)) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	id := fw.addHandler(notify)
+	err := fw.addFile(path, watchPath{root: path, ops: ops, handler: id})
+	if err != nil {
+		fw.removeHandler(id)
+	}
+	return err
+}
+
+// AddDirNotify is like AddDir, but notify is called with the events for this
+// directory alone, along with every error. With recursion that includes the
+// directories beneath it. Events are still delivered to WaitEvent and any
+// subscribers as usual.
+// The handler is dropped when the directory is removed with RemoveDir, or
+// after it has been sent the Lost event for the directory.
+func (fw *FileSystemWatcher) AddDirNotify(path, pattern string, ops Op, recursive bool, notify func(*Event, error)) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	id := fw.addHandler(notify)
+	err := fw.addDirs(path, watchPath{root: path, include: patterns(pattern), ops: ops, recursive: recursive, handler: id})
+	if err != nil {
+		fw.removeHandler(id)
+	}
+	return err
+}
+
+// addHandler subscribes notify to the events matched against watchPaths that
+// are given the returned handler id. fw.mu must be held.
+func (fw *FileSystemWatcher) addHandler(notify func(*Event, error)) int {
+	fw.nextHandler++
+	id := fw.nextHandler
+
+	events, errs, cancel := fw.Subscribe(func(e Event) bool {
+		return e.watch != nil && e.watch.handler == id
+	})
+	fw.handlers[id] = cancel
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				notify(&event, nil)
+				// Nothing more can arrive for a path that has been lost.
+				if event.Op&Lost == Lost {
+					fw.mu.Lock()
+					fw.removeHandler(id)
+					fw.mu.Unlock()
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					return
+				}
+				notify(nil, err)
+			}
+		}
+	}()
+	return id
+}
+
+// removeHandler stops calling the handler with the given id. fw.mu must be
+// held.
+func (fw *FileSystemWatcher) removeHandler(id int) {
+	if cancel, ok := fw.handlers[id]; ok {
+		cancel()
+		delete(fw.handlers, id)
+	}
+}
+
+// dropHandler removes the handler of old if old is the path it was added for
+// and it is not the handler to keep. fw.mu must be held.
+func (fw *FileSystemWatcher) dropHandler(old *watchPath, keep int) {
+	if old == nil || old.handler == 0 || old.handler == keep {
+		return
+	}
+	if filepath.Clean(old.root) != filepath.Clean(old.path) {
+		return
+	}
+	if fw.heldHandlers != nil {
+		*fw.heldHandlers = append(*fw.heldHandlers, old.handler)
+		return
+	}
+	fw.removeHandler(old.handler)
+}
@@ -0,0 +1,147 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure each handler only sees the events for its own path.
+func TestAddDirNotify(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.ini")
+	templates := filepath.Join(dir, "templates")
+	os.MkdirAll(filepath.Join(templates, "sub"), 0700)
+	ioutil.WriteFile(config, []byte("test"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	configEvents := make(chan *Event, 10)
+	err := fw.AddFileNotify(config, Write, func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		configEvents <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templateEvents := make(chan *Event, 10)
+	err = fw.AddDirNotify(templates, "*.tmpl", Create, true, func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		templateEvents <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events still go to everything else as well.
+	all := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		all <- event
+	})
+
+	template := filepath.Join(templates, "sub", "page.tmpl")
+	ioutil.WriteFile(template, []byte("test"), 0700)
+	ioutil.WriteFile(config, []byte("test"), 0700)
+	send(b, Event{Name: template, Op: Create}, Event{Name: config, Op: Write})
+
+	wait := func(events chan *Event, name string) {
+		select {
+		case event := <-events:
+			if event.Name != name {
+				t.Fatal("Got the wrong event:", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	wait(templateEvents, template)
+	wait(configEvents, config)
+	wait(all, template)
+	wait(all, config)
+
+	// Nothing else should turn up for either handler. The template's
+	// handler did not ask for Write, so if the config Write after it is the
+	// next event delivered at all, it was filtered out.
+	send(b, Event{Name: template, Op: Write}, Event{Name: config, Op: Write})
+	wait(all, config)
+	wait(configEvents, config)
+	select {
+	case event := <-templateEvents:
+		t.Fatal("Got an extra event:", event)
+	default:
+	}
+
+	err = fw.RemoveFile(config)
+	if err != nil {
+		t.Error(err)
+	}
+	fw.mu.RLock()
+	handlers := len(fw.handlers)
+	fw.mu.RUnlock()
+	if handlers != 1 {
+		t.Fatal("Wanted 1 handler left got", handlers)
+	}
+}
+
+// Make sure a handler is told when its directory is lost and then dropped.
+func TestAddDirNotifyLost(t *testing.T) {
+	parent := makeTestDir(t)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "root")
+	os.MkdirAll(dir, 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	events := make(chan *Event, 10)
+	err := fw.AddDirNotify(dir, "", Create, false, func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(dir)
+	send(b, Event{Name: dir, Op: Remove})
+
+	select {
+	case event := <-events:
+		if event.Op != Lost {
+			t.Fatal("Wanted Lost got", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	// The handler is dropped once notify has returned for the Lost event.
+	deadline := time.After(time.Second)
+	for {
+		fw.mu.RLock()
+		handlers := len(fw.handlers)
+		fw.mu.RUnlock()
+		if handlers == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Handler was not dropped")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package bcnotify
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultMaxHashSize is the largest file, in bytes, whose contents are hashed
+// by WithContentHash if it is not given a size.
+const DefaultMaxHashSize = 1 << 20
+
+// racyWindow is how much older than its hash a file's modification time must
+// be for the time to be trusted. File systems only keep the time to within
+// their granularity, which is 2s on FAT and can be as coarse on NFS, so a file
+// written again within that of being hashed can keep the same time.
+const racyWindow = 2 * time.Second
+
+// WithContentHash drops Write and Chmod events for files whose contents and
+// permissions have not changed, such as those caused by touch or by an editor
+// saving a file that has not been changed.
+//
+// A hash of each file is kept once an event has been seen for it, or once it
+// is added with AddFile. The first Write for a file in a directory is always
+// delivered, since there is nothing to compare it with. The file is only
+// hashed again if its size or modification time have changed, or if it was
+// modified shortly before it was last hashed, since a change made then may not
+// have moved its modification time on. Files larger than maxSize bytes are
+// never hashed and always notified. If maxSize is zero or less,
+// DefaultMaxHashSize is used.
+func WithContentHash(maxSize int64) Option {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxHashSize
+	}
+	return func(fw *FileSystemWatcher) {
+		fw.hashes = &contentHashes{
+			maxSize: maxSize,
+			files:   make(map[string]fileHash),
+		}
+	}
+}
+
+// fileHash is what is known about the contents of a file.
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	sum     [sha256.Size]byte
+	hashed  time.Time // when the hash was taken
+}
+
+// contentHashes keeps the hashes of the files seen. It is safe for concurrent
+// use.
+type contentHashes struct {
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]fileHash
+}
+
+// unchanged returns whether e is a Write or Chmod for a file whose contents
+// and permissions are the same as when it was last seen. It records the file
+// as it is now for next time.
+func (fw *FileSystemWatcher) unchanged(e *Event) bool {
+	if fw.hashes == nil {
+		return false
+	}
+	changed := fw.hashes.update(e.Name)
+	return !changed && e.Op&^(Write|Chmod) == 0
+}
+
+// update records the file at path as it is now, and returns whether it is any
+// different from when it was last recorded. Anything that cannot be hashed is
+// taken to have changed.
+func (h *contentHashes) update(path string) bool {
+	path = filepath.Clean(path)
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > h.maxSize {
+		h.forget(path)
+		return true
+	}
+
+	h.mu.Lock()
+	old, ok := h.files[path]
+	h.mu.Unlock()
+	if ok && old.size == info.Size() && old.modTime.Equal(info.ModTime()) && old.mode == info.Mode() &&
+		old.modTime.Before(old.hashed.Add(-racyWindow)) {
+		return false
+	}
+
+	// Note the time before reading, so that anything written while the file is
+	// read counts as racy.
+	hashed := time.Now()
+	sum, err := hashFile(path)
+	if err != nil {
+		h.forget(path)
+		return true
+	}
+	h.mu.Lock()
+	h.files[path] = fileHash{size: info.Size(), modTime: info.ModTime(), mode: info.Mode(), sum: sum, hashed: hashed}
+	h.mu.Unlock()
+	return !ok || old.sum != sum || old.mode != info.Mode()
+}
+
+// forget drops what is known about the file at path.
+func (h *contentHashes) forget(path string) {
+	h.mu.Lock()
+	delete(h.files, filepath.Clean(path))
+	h.mu.Unlock()
+}
+
+// hashFile returns the hash of the contents of the file at path.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,144 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rewrite writes data over the start of the file at path without truncating
+// it first, so that only a single Write happens.
+func rewrite(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Make sure Write and Chmod events are only delivered when something changed.
+func TestWithContentHash(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(file, []byte("one"), 0700)
+
+	fw, _ := NewFileSystemWatcher(WithContentHash(0))
+	defer fw.Close()
+
+	err := fw.AddFile(file, Write|Chmod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	expectNone := func(what string) {
+		select {
+		case event := <-events:
+			t.Fatalf("Got an event after %s: %s", what, event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	expect := func(what string, op Op) {
+		select {
+		case event := <-events:
+			if event.Op != op {
+				t.Fatalf("Wanted %s after %s got %s", op, what, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event after", what)
+		}
+	}
+
+	rewrite(t, file, "one")
+	expectNone("writing the same contents")
+
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(file, later, later)
+	expectNone("touching the file")
+
+	rewrite(t, file, "two")
+	expect("writing new contents", Write)
+
+	os.Chmod(file, 0600)
+	expect("changing its permissions", Chmod)
+}
+
+// Make sure files larger than the limit are always taken to have changed.
+func TestContentHashesMaxSize(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	small := filepath.Join(dir, "small")
+	large := filepath.Join(dir, "large")
+	ioutil.WriteFile(small, []byte("tiny"), 0700)
+	ioutil.WriteFile(large, []byte("much too large"), 0700)
+
+	h := &contentHashes{maxSize: 4, files: make(map[string]fileHash)}
+	for _, path := range []string{small, large} {
+		if !h.update(path) {
+			t.Fatal("A file seen for the first time should have changed:", path)
+		}
+	}
+	if h.update(small) {
+		t.Fatal("The small file should not have changed")
+	}
+	if !h.update(large) {
+		t.Fatal("The large file should always have changed")
+	}
+	if !h.update(filepath.Join(dir, "missing")) {
+		t.Fatal("A missing file should always have changed")
+	}
+}
+
+// Make sure a file written again with the same size and modification time is
+// hashed again if the time is too close to when it was last hashed to trust.
+func TestContentHashesRacy(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test")
+	ioutil.WriteFile(path, []byte("test"), 0700)
+
+	h := &contentHashes{maxSize: DefaultMaxHashSize, files: make(map[string]fileHash)}
+	h.update(path)
+	info, _ := os.Stat(path)
+
+	// As on a file system that only keeps the time to the second or two.
+	rewrite(t, path, "next")
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+	if !h.update(path) {
+		t.Fatal("A change within the time granularity was missed")
+	}
+
+	// A file that was last changed long before it was hashed is trusted.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path, old, old)
+	h.update(path)
+	h.mu.Lock()
+	before := h.files[filepath.Clean(path)].hashed
+	h.mu.Unlock()
+	if h.update(path) {
+		t.Fatal("The file should not have changed")
+	}
+	h.mu.Lock()
+	after := h.files[filepath.Clean(path)].hashed
+	h.mu.Unlock()
+	if !after.Equal(before) {
+		t.Fatal("The file was hashed again although its time could be trusted")
+	}
+}
@@ -0,0 +1,223 @@
+package bcnotify
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// ignoreRule is a single line of an ignore file.
+type ignoreRule struct {
+	pattern string // Pattern for matchGlob, relative to the ignore file
+	negate  bool   // True if the line started with "!"
+	dirOnly bool   // True if the line ended with "/"
+}
+
+// parseIgnore reads the rules from the contents of an ignore file, which uses
+// the same syntax as .gitignore.
+func parseIgnore(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var rule ignoreRule
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			// Escapes a leading "#" or "!".
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		// A pattern with a slash at the start or in the middle is relative to
+		// the directory of the ignore file. Anything else matches at any depth.
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// match returns whether the rule applies to rel, a path relative to the
+// directory of the ignore file using forward slashes.
+func (r ignoreRule) match(rel string, isdir bool) bool {
+	if r.dirOnly && !isdir {
+		return false
+	}
+	match, err := matchGlob(r.pattern, rel)
+	return err == nil && match
+}
+
+// ignoreSet holds the rules from the ignore files found beneath a directory
+// added with DirOptions.IgnoreFiles. It is shared by every watchPath for that
+// directory, and is safe for concurrent use.
+type ignoreSet struct {
+	root  string   // Directory that was added
+	names []string // Names of the ignore files to read, such as ".gitignore"
+
+	mu    sync.RWMutex
+	rules map[string][]ignoreRule // rules from the ignore files in each directory
+}
+
+// newIgnoreSet returns an ignoreSet that reads the named ignore files from the
+// directories beneath root.
+func newIgnoreSet(root string, names []string) *ignoreSet {
+	return &ignoreSet{
+		root:  filepath.Clean(root),
+		names: names,
+		rules: make(map[string][]ignoreRule),
+	}
+}
+
+// isIgnoreFile returns whether path is one of the ignore files.
+func (s *ignoreSet) isIgnoreFile(path string) bool {
+	name := filepath.Base(path)
+	for _, n := range s.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// load (re)reads the ignore files in dir. Rules from later files in names come
+// after those from earlier ones, so they win.
+func (s *ignoreSet) load(dir string) error {
+	var rules []ignoreRule
+	for _, name := range s.names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		rules = append(rules, parseIgnore(data)...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if len(rules) == 0 {
+		delete(s.rules, dir)
+	} else {
+		s.rules[dir] = rules
+	}
+	return nil
+}
+
+// drop forgets the rules for dir and every directory beneath it.
+func (s *ignoreSet) drop(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+	for d := range s.rules {
+		if d == dir || strings.HasPrefix(d, prefix) {
+			delete(s.rules, d)
+		}
+	}
+}
+
+// ignored returns whether path is ignored by the rules of the directories
+// between the root and path. As with .gitignore, rules from deeper directories
+// win over those from shallower ones, and later rules win over earlier ones.
+func (s *ignoreSet) ignored(path string, isdir bool) bool {
+	rel, err := filepath.Rel(s.root, filepath.Clean(path))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ignored := false
+	dir := s.root
+	for i := range elems {
+		for _, rule := range s.rules[dir] {
+			if rule.match(strings.Join(elems[i:], "/"), isdir) {
+				ignored = !rule.negate
+			}
+		}
+		dir = filepath.Join(dir, elems[i])
+	}
+	return ignored
+}
+
+// reloadIgnores rereads an ignore file that has changed, and brings the
+// watched directories beneath it up to date with its rules.
+func (fw *FileSystemWatcher) reloadIgnores(path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	dir := filepath.Dir(path)
+	p := fw.watchPaths.get(filepath.Clean(dir))
+	if p == nil || !p.isdir || p.ignores == nil || !p.ignores.isIgnoreFile(path) {
+		return
+	}
+	if err := p.ignores.load(dir); err != nil {
+		fw.pushPending(queued{err: err})
+		return
+	}
+	if !p.recursive {
+		return
+	}
+	if err := fw.rescan(dir, *p); err != nil {
+		fw.pushPending(queued{err: err})
+	}
+}
+
+// rescan walks dir, adding directories that should be watched but are not,
+// and removing ones that are watched but should not be. fw.mu must be held.
+func (fw *FileSystemWatcher) rescan(dir string, conf watchPath) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return stackerr.Wrap(err)
+		}
+		if p == dir || !info.IsDir() {
+			return nil
+		}
+		watched := fw.watchPaths.get(filepath.Clean(p)) != nil
+		if conf.skipDir(p, info) {
+			for _, sub := range fw.watchPaths.subtree(p) {
+				if sub.persistent {
+					continue
+				}
+				fw.unwatch(sub.path)
+				fw.watchPaths.remove(sub.path)
+			}
+			conf.ignores.drop(p)
+			return filepath.SkipDir
+		}
+		if !watched {
+			if e := fw.addDir(p, conf); e != nil && exists(p) {
+				return stackerr.Wrap(e)
+			}
+		}
+		return nil
+	})
+}
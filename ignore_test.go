@@ -0,0 +1,137 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure ignore file rules follow .gitignore.
+func TestIgnoreSet(t *testing.T) {
+	s := newIgnoreSet("root", []string{".gitignore"})
+	s.rules["root"] = parseIgnore([]byte(`# Comment
+*.log
+!keep.log
+build/
+/only-top.txt
+docs/**/*.tmp
+\#hash
+`))
+	s.rules[filepath.Join("root", "sub")] = parseIgnore([]byte("*.txt\n!keep.log\nnested.log\n"))
+
+	tests := []struct {
+		path    string
+		isdir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"deep/a/b.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"a/build", true, true},
+		{"only-top.txt", false, true},
+		{"a/only-top.txt", false, false},
+		{"docs/x/y.tmp", false, true},
+		{"docs/y.tmp", false, true},
+		{"x.tmp", false, false},
+		{"#hash", false, true},
+		{"sub/a.txt", false, true},
+		{"sub/deeper/a.txt", false, true},
+		{"other/a.txt", false, false},
+		{"sub/nested.log", false, true},
+		{"sub/keep.log", false, false},
+		{".", true, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join("root", filepath.FromSlash(test.path))
+		if s.ignored(path, test.isdir) != test.ignored {
+			t.Fatalf("ignored(%q, %v) should be %v", test.path, test.isdir, test.ignored)
+		}
+	}
+}
+
+// Make sure ignored directories are never watched, ignored files are never
+// notified, and changes to ignore files are picked up.
+func TestAddDirOptionsIgnoreFiles(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	modules := filepath.Join(dir, "node_modules", "lib")
+	os.MkdirAll(modules, 0700)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+	ignore := filepath.Join(dir, ".gitignore")
+	ioutil.WriteFile(ignore, []byte("node_modules/\n*.log\n"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "sub", ".gitignore"), []byte("*.tmp\n"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDirOptions(dir, DirOptions{
+		Ops:         Create,
+		Recursive:   true,
+		IgnoreFiles: []string{".gitignore"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.findWatchPath(filepath.Join(modules, "x")) != nil {
+		t.Fatal("Ignored directory is watched")
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	// The file that is not ignored comes last, so the others must have been
+	// filtered out if it is the first event delivered.
+	want := filepath.Join(dir, "sub", "test.txt")
+	var sent []Event
+	for _, name := range []string{
+		filepath.Join(dir, "test.log"),
+		filepath.Join(dir, "sub", "test.tmp"),
+		filepath.Join(dir, "node_modules", "test.txt"),
+		want,
+	} {
+		ioutil.WriteFile(name, []byte("test"), 0700)
+		sent = append(sent, Event{Name: name, Op: Create})
+	}
+	send(b, sent...)
+	wait := func(want string) {
+		select {
+		case event := <-events:
+			if event.Name != want {
+				t.Fatal("Notified of ignored file:", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	wait(want)
+
+	// Stop ignoring node_modules. The watcher takes one event at a time, so
+	// the change has been picked up once the file after it is delivered.
+	marker := filepath.Join(dir, "marker.txt")
+	ioutil.WriteFile(marker, []byte("test"), 0700)
+	ioutil.WriteFile(ignore, []byte("*.log\n"), 0700)
+	send(b, Event{Name: ignore, Op: Write}, Event{Name: marker, Op: Create})
+	wait(marker)
+	if fw.findWatchPath(filepath.Join(modules, "x")) == nil || !b.Watching(modules) {
+		t.Fatal("Directory was not watched after its ignore rule was removed")
+	}
+
+	// And ignore sub instead.
+	ioutil.WriteFile(ignore, []byte("sub/\n"), 0700)
+	send(b, Event{Name: ignore, Op: Write}, Event{Name: marker, Op: Create})
+	wait(marker)
+	if fw.findWatchPath(filepath.Join(dir, "sub", "x")) != nil || b.Watching(filepath.Join(dir, "sub")) {
+		t.Fatal("Directory is still watched after it was ignored")
+	}
+}
@@ -0,0 +1,78 @@
+package bcnotify
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// WatchLimitError is returned when a path cannot be watched because the
+// operating system will not give out any more watches. On Linux that is the
+// fs.inotify.max_user_watches limit, which large trees soon reach.
+type WatchLimitError struct {
+	Path string // Path that could not be watched
+	Err  error  // Error from the Backend
+}
+
+func (e *WatchLimitError) Error() string {
+	return fmt.Sprintf("Can't watch %s, the limit on watches has been reached (raise fs.inotify.max_user_watches or use WithPollingFallback): %s", e.Path, e.Err)
+}
+
+// IsWatchLimit returns whether err, or an error it wraps, is a
+// WatchLimitError.
+func IsWatchLimit(err error) bool {
+	return stackerr.HasUnderlying(err, func(err error) bool {
+		_, ok := err.(*WatchLimitError)
+		return ok
+	})
+}
+
+// WithPollingFallback makes the FileSystemWatcher poll paths at interval
+// once the operating system will not give out any more watches, instead of
+// failing with a WatchLimitError. Directories added after that, including
+// the rest of a tree that was being added, are polled, so nothing is left
+// unwatched. Paths go back to being watched by the operating system when they
+// are added again once watches have been freed.
+//
+// See WithPolling for how the events found by polling differ.
+func WithPollingFallback(interval time.Duration) Option {
+	return func(fw *FileSystemWatcher) {
+		fw.fallback = interval
+	}
+}
+
+// watchLimited handles err from the Backend failing to watch path. If the
+// limit on watches has been reached, path is polled instead when there is a
+// fallback, or a WatchLimitError is returned. Other errors are returned as
+// they are.
+func (fw *FileSystemWatcher) watchLimited(path string, err error) error {
+	if !isWatchLimit(err) {
+		return err
+	}
+	if fw.fallback > 0 {
+		return fw.poller.Add(path, fw.fallback)
+	}
+	return &WatchLimitError{Path: path, Err: err}
+}
+
+// rollback puts the watchPaths beneath path back to how they were in
+// before, which holds what subtree returned before a recursive add. Anything
+// added since is no longer watched. The handlers of the paths that were
+// replaced are still running, since addDirs only drops them once it has
+// succeeded. fw.mu must be held.
+func (fw *FileSystemWatcher) rollback(path string, before map[string]*watchPath) {
+	for _, p := range fw.watchPaths.subtree(path) {
+		old, ok := before[filepath.Clean(p.path)]
+		if old == p {
+			continue
+		}
+		if ok {
+			fw.watchPaths.add(*old)
+			continue
+		}
+		fw.unwatch(p.path)
+		fw.watchPaths.remove(p.path)
+	}
+}
@@ -0,0 +1,9 @@
+package bcnotify
+
+import "syscall"
+
+// isWatchLimit returns whether err is inotify running out of watches, which it
+// reports as ENOSPC.
+func isWatchLimit(err error) bool {
+	return err == syscall.ENOSPC
+}
@@ -0,0 +1,166 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// limitedBackend is a FakeBackend that runs out of watches the way inotify
+// does once it is watching limit paths.
+type limitedBackend struct {
+	*FakeBackend
+	limit int
+}
+
+func (b *limitedBackend) Add(path string) error {
+	if len(b.Watched()) >= b.limit && !b.Watching(path) {
+		return syscall.ENOSPC
+	}
+	return b.FakeBackend.Add(path)
+}
+
+// makeTestTree makes a test directory with three directories beneath it.
+func makeTestTree(t *testing.T) string {
+	dir := makeTestDir(t)
+	for _, sub := range []string{"a", "b", "c"} {
+		os.Mkdir(filepath.Join(dir, sub), 0700)
+	}
+	return dir
+}
+
+// Make sure running out of watches is reported, and that a tree that could not
+// be added in full is not left half watched.
+func TestWatchLimit(t *testing.T) {
+	dir := makeTestTree(t)
+	defer os.RemoveAll(dir)
+
+	b := &limitedBackend{FakeBackend: NewFakeBackend(), limit: 2}
+	fw, err := NewFileSystemWatcher(WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	// Already watched, so it must be left as it is.
+	if err := fw.AddDir(dir, "", Create, false); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fw.AddDir(dir, "*.txt", AllOps, true)
+	if !IsWatchLimit(err) {
+		t.Fatal("Wanted a WatchLimitError got", err)
+	}
+	if !strings.Contains(err.Error(), "max_user_watches") {
+		t.Fatal("Error does not say what to do:", err)
+	}
+
+	if watched := b.Watched(); len(watched) != 1 || watched[0] != filepath.Clean(dir) {
+		t.Fatal("Wrong paths left watched:", watched)
+	}
+	if fw.watchPaths.len() != 1 {
+		t.Fatal("Paths left behind:", fw.watchPaths.paths)
+	}
+	p := fw.findWatchPath(filepath.Join(dir, "test.txt"))
+	if p == nil || p.recursive || p.ops != Create || len(p.include) != 0 {
+		t.Fatal("Directory that was already watched was not put back")
+	}
+
+	if IsWatchLimit(os.ErrNotExist) {
+		t.Fatal("IsWatchLimit is true for other errors")
+	}
+}
+
+// Make sure the handler of a directory is kept when adding it again fails.
+func TestWatchLimitKeepsHandler(t *testing.T) {
+	dir := makeTestTree(t)
+	defer os.RemoveAll(dir)
+
+	b := &limitedBackend{FakeBackend: NewFakeBackend(), limit: 2}
+	fw, err := NewFileSystemWatcher(WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	handled := make(chan *Event, 10)
+	err = fw.AddDirNotify(dir, "", Create, false, func(event *Event, err error) {
+		handled <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.AddDir(dir, "", AllOps, true); !IsWatchLimit(err) {
+		t.Fatal("Wanted a WatchLimitError got", err)
+	}
+	if len(fw.handlers) != 1 {
+		t.Fatal("Wanted 1 handler got", len(fw.handlers))
+	}
+
+	filename := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b.FakeBackend, Event{Name: filename, Op: Create})
+	select {
+	case event := <-handled:
+		if event == nil || event.Name != filename {
+			t.Fatal("Handler got the wrong event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the handler")
+	}
+}
+
+// Make sure directories are polled once out of watches with
+// WithPollingFallback.
+func TestWatchLimitFallback(t *testing.T) {
+	dir := makeTestTree(t)
+	defer os.RemoveAll(dir)
+
+	b := &limitedBackend{FakeBackend: NewFakeBackend(), limit: 2}
+	fw, err := NewFileSystemWatcher(WithBackend(b), WithPollingFallback(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	if err := fw.AddDir(dir, "*.txt", Create, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Watched()) != 2 {
+		t.Fatal("Wrong paths watched:", b.Watched())
+	}
+
+	// Every directory is watched one way or the other.
+	var polled []string
+	for _, sub := range []string{"", "a", "b", "c"} {
+		path := filepath.Join(dir, sub)
+		if fw.poller.has(path) {
+			polled = append(polled, path)
+		} else if !b.Watching(path) {
+			t.Fatal("Not watching", path)
+		}
+	}
+	if len(polled) != 2 {
+		t.Fatal("Wanted 2 directories polled got", polled)
+	}
+
+	filename := filepath.Join(polled[0], "test.txt")
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	if event := waitEvent(t, fw); event.Name != filename || event.Op != Create {
+		t.Fatal("Wanted Create for", filename, "got", event)
+	}
+
+	if err := fw.RemoveDir(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range polled {
+		if fw.poller.has(path) {
+			t.Fatal("Still polling", path)
+		}
+	}
+}
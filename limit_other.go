@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package bcnotify
+
+// isWatchLimit returns whether err is the operating system running out of
+// watches. Only inotify has a limit of its own.
+func isWatchLimit(err error) bool {
+	return false
+}
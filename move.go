@@ -0,0 +1,130 @@
+package bcnotify
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// movePairWindow is how long to wait for the Create that goes with a Rename.
+// fsnotify sends the two straight after each other when both ends of a move
+// are watched, so this only delays Renames out of the watched paths.
+var movePairWindow = 20 * time.Millisecond
+
+// wantsMove returns whether Move was asked for on the path that fits path.
+func (fw *FileSystemWatcher) wantsMove(path string) bool {
+	p := fw.findWatchPath(path)
+	return p != nil && p.ops&Move == Move
+}
+
+// pairMove waits briefly for the Create that goes with a Rename of oldEvent's
+// path and returns a Move for the two if it comes. Otherwise the Rename is
+// reported as a Remove, since the file has left the watched paths.
+func (fw *FileSystemWatcher) pairMove(oldEvent fsnotify.Event) *Event {
+	// When a watched directory is moved, its own watch reports a second Rename
+	// after the pair, which is already covered by the Move.
+	fw.pendingMu.Lock()
+	repeat := fw.lastMove == oldEvent.Name
+	fw.lastMove = ""
+	fw.pendingMu.Unlock()
+	if repeat {
+		fw.bookkeep(oldEvent)
+		return nil
+	}
+
+	// Find out which watch the old path belonged to before bookkeeping can
+	// forget it.
+	src := fw.findWatchPath(oldEvent.Name)
+	fw.bookkeep(oldEvent)
+
+	next, ok := fw.nextEvent(movePairWindow)
+	if !ok || next.Op != fsnotify.Create {
+		// Moved out of the watched paths. Report it as a Remove and leave
+		// whatever came next to be handled as usual.
+		removed := queued{event: fsnotify.Event{Name: oldEvent.Name, Op: fsnotify.Remove}, synthetic: true, watch: src}
+		if ok {
+			fw.unshiftPending(removed, queued{event: next})
+		} else {
+			fw.unshiftPending(removed)
+		}
+		return nil
+	}
+
+	dst := fw.findWatchPath(next.Name)
+	fw.bookkeep(next)
+
+	// Only a watched directory has a watch of its own to report the move.
+	if src != nil && src.isdir && filepath.Clean(src.path) == filepath.Clean(oldEvent.Name) {
+		fw.pendingMu.Lock()
+		fw.lastMove = oldEvent.Name
+		fw.pendingMu.Unlock()
+	}
+
+	// Prefer the new path's watch for where the event belongs.
+	e := wrapEvent(next)
+	e.Op = Move
+	e.OldName = oldEvent.Name
+	if dst != nil && dst.matchOp(Move) {
+		e.watch = dst
+		if dst.matchEvent(e) {
+			return e
+		}
+	}
+	if src != nil && src.matchOp(Move) {
+		// The old path is what the source watch's filters know about.
+		old := *e
+		old.Name = oldEvent.Name
+		old.watch = src
+		if src.matchEvent(&old) {
+			e.watch = src
+			return e
+		}
+	}
+
+	// Neither end wants to hear about the Move, so send the two events on as
+	// they came.
+	fw.unshiftPending(queued{event: oldEvent, synthetic: true, watch: src}, queued{event: next, synthetic: true})
+	return nil
+}
+
+// forgetMove stops a later Rename of the path last moved from being taken for
+// the moved directory's own watch reporting the move. The watch reports it
+// straight after the pair, so anything else in between means it is not that.
+func (fw *FileSystemWatcher) forgetMove() {
+	fw.pendingMu.Lock()
+	fw.lastMove = ""
+	fw.pendingMu.Unlock()
+}
+
+// nextEvent returns the next event from the queue or fsnotify, waiting at most
+// timeout for one to arrive. Errors from fsnotify are queued to be returned
+// by WaitEvent.
+func (fw *FileSystemWatcher) nextEvent(timeout time.Duration) (fsnotify.Event, bool) {
+	if q, ok := fw.popPending(); ok {
+		if q.err == nil && !q.synthetic && q.ready == nil && !q.held {
+			return q.event, true
+		}
+		fw.unshiftPending(q)
+		return fsnotify.Event{}, false
+	}
+	select {
+	case event, ok := <-fw.watcher.Events():
+		return rawEvent(event), ok
+	case err, ok := <-fw.watcher.Errors():
+		if ok {
+			fw.pushPending(queued{err: stackerr.Wrap(err)})
+		}
+	case event, ok := <-fw.poller.Events():
+		return rawEvent(event), ok
+	case err, ok := <-fw.poller.Errors():
+		if ok {
+			fw.pushPending(queued{err: err})
+		}
+	case <-time.After(timeout):
+	case <-fw.close:
+	}
+	return fsnotify.Event{}, false
+}
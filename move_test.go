@@ -0,0 +1,169 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure moves between watched directories are paired up, and moves out of
+// them are reported as removes.
+func TestMove(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	outside := makeTestDir(t)
+	defer os.RemoveAll(outside)
+
+	os.MkdirAll(filepath.Join(dir, "a"), 0700)
+	os.MkdirAll(filepath.Join(dir, "b"), 0700)
+	oldName := filepath.Join(dir, "a", "test.txt")
+	newName := filepath.Join(dir, "b", "moved.txt")
+	ioutil.WriteFile(oldName, []byte("test"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Remove|Move, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	wait := func(op Op, name, oldName string) {
+		select {
+		case event := <-events:
+			if event.Op != op || event.Name != name || event.OldName != oldName {
+				t.Fatal("Got the wrong event:", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+
+	os.Rename(oldName, newName)
+	send(b, Event{Name: oldName, Op: Rename}, Event{Name: newName, Op: Create})
+	wait(Move, newName, oldName)
+
+	os.Rename(newName, filepath.Join(outside, "moved.txt"))
+	send(b, Event{Name: newName, Op: Rename})
+	wait(Remove, newName, "")
+
+	// Moving a directory should not report anything else for it, so the
+	// Remove after its own Rename is the next event delivered.
+	from, to := filepath.Join(dir, "a"), filepath.Join(dir, "b", "a")
+	other := filepath.Join(dir, "b", "other.txt")
+	os.Rename(from, to)
+	send(b,
+		Event{Name: from, Op: Rename},
+		Event{Name: to, Op: Create},
+		Event{Name: from, Op: Rename},
+		Event{Name: other, Op: Remove},
+	)
+	wait(Move, to, from)
+	wait(Remove, other, "")
+}
+
+// Make sure moves are reported as before unless Move is asked for.
+func TestMoveNotAsked(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	oldName := filepath.Join(dir, "test.txt")
+	newName := filepath.Join(dir, "moved.txt")
+	ioutil.WriteFile(oldName, []byte("test"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	os.Rename(oldName, newName)
+	send(b, Event{Name: oldName, Op: Rename}, Event{Name: newName, Op: Create})
+
+	for _, want := range []Event{{Name: oldName, Op: Rename}, {Name: newName, Op: Create}} {
+		event, err := fw.WaitEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Name != want.Name || event.Op != want.Op {
+			t.Fatalf("Wanted %s got %s", want, event)
+		}
+	}
+}
+
+// Make sure a Rename is only taken for a moved directory reporting its own
+// move when it comes straight after the move.
+func TestMoveSameNameAgain(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps|Move, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(dir, "a")
+	want := func(op Op, name, oldName string) {
+		event := waitEvent(t, fw)
+		if event.Op != op || event.Name != name || event.OldName != oldName {
+			t.Fatal("Wanted", op, name, "from", oldName, "got", event, "from", event.OldName)
+		}
+	}
+
+	// mv a b; touch a; mv a c
+	ioutil.WriteFile(a, []byte("test"), 0700)
+	os.Rename(a, filepath.Join(dir, "b"))
+	send(b, Event{Name: a, Op: Rename}, Event{Name: filepath.Join(dir, "b"), Op: Create})
+	want(Move, filepath.Join(dir, "b"), a)
+
+	ioutil.WriteFile(a, []byte("test"), 0700)
+	send(b, Event{Name: a, Op: Create})
+	want(Create, a, "")
+
+	os.Rename(a, filepath.Join(dir, "c"))
+	send(b, Event{Name: a, Op: Rename}, Event{Name: filepath.Join(dir, "c"), Op: Create})
+	want(Move, filepath.Join(dir, "c"), a)
+
+	// A watched directory reports its own move after the pair, which is
+	// dropped, but the next Rename of its old name is not.
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0700)
+	send(b, Event{Name: sub, Op: Create})
+	want(Create, sub, "")
+
+	os.Rename(sub, filepath.Join(dir, "moved"))
+	send(b,
+		Event{Name: sub, Op: Rename},
+		Event{Name: filepath.Join(dir, "moved"), Op: Create},
+		Event{Name: sub, Op: Rename},
+		Event{Name: filepath.Join(dir, "c"), Op: Write},
+	)
+	want(Move, filepath.Join(dir, "moved"), sub)
+	want(Write, filepath.Join(dir, "c"), "")
+
+	os.Mkdir(sub, 0700)
+	os.Rename(sub, filepath.Join(dir, "again"))
+	send(b,
+		Event{Name: sub, Op: Create},
+		Event{Name: sub, Op: Rename},
+		Event{Name: filepath.Join(dir, "again"), Op: Create},
+	)
+	want(Create, sub, "")
+	want(Move, filepath.Join(dir, "again"), sub)
+}
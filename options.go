@@ -0,0 +1,185 @@
+package bcnotify
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirOptions describes how a directory added with AddDirOptions is watched.
+type DirOptions struct {
+	// Include lists the patterns a file must match one of to be watched. Each
+	// is matched the same way as the pattern given to AddDir. Every file is
+	// watched if it is empty.
+	Include []string
+
+	// Exclude lists patterns that stop a file being watched even if it
+	// matches Include.
+	Exclude []string
+
+	// Filter, if set, must also match an event for it to be delivered. It is
+	// checked after Include and Exclude.
+	Filter Filter
+
+	// Ops are the operations to watch. AllOps is used if it is zero.
+	Ops Op
+
+	// Recursive adds the directories beneath the directory as well.
+	Recursive bool
+
+	// IgnoreFiles names files, such as ".gitignore" or ".dockerignore", to
+	// read from the directory and every directory beneath it. They use the
+	// same syntax as .gitignore, and their rules apply to the directory they
+	// are in and everything beneath it. Ignored directories are not watched at
+	// all and ignored files are never notified. The files are read again
+	// whenever they change.
+	IgnoreFiles []string
+
+	// SkipDirs lists patterns for directories beneath the directory that are
+	// not watched at all, such as "node_modules" or "build/**". They are
+	// matched the same way as Include, and only apply with Recursive. Nothing
+	// inside a skipped directory is ever notified, which saves adding a watch
+	// for each directory in a large tree that is of no interest.
+	SkipDirs []string
+
+	// SkipDir, if set, is called for each directory beneath the directory,
+	// both when it is added and when directories are created later. Returning
+	// true leaves that directory, and everything beneath it, unwatched.
+	SkipDir SkipDirFunc
+
+	// PollInterval, if greater than zero, has the directory polled that
+	// often instead of relying on notifications, as with WithPolling.
+	PollInterval time.Duration
+
+	// Notify, if set, is called with the events for this directory alone, as
+	// with AddDirNotify.
+	Notify func(*Event, error)
+}
+
+// SkipDirFunc says whether the directory at path should be left unwatched.
+// info describes the directory as it was when it was found.
+type SkipDirFunc func(path string, info os.FileInfo) bool
+
+// AddDirOptions adds a directory to be watched as described by opts, returning
+// an error if any. It is like AddDir, but allows more than one pattern.
+//
+// A file is watched if it matches any of opts.Include (or opts.Include is
+// empty) and does not match any of opts.Exclude, so "*.go" and "*.tmpl" but
+// not "*_test.go" is:
+//
+//	fw.AddDirOptions(dir, bcnotify.DirOptions{
+//		Include: []string{"*.go", "*.tmpl"},
+//		Exclude: []string{"*_test.go"},
+//	})
+func (fw *FileSystemWatcher) AddDirOptions(path string, opts DirOptions) error {
+	all := append(append([]string(nil), opts.Include...), opts.Exclude...)
+	for _, pattern := range append(all, opts.SkipDirs...) {
+		if err := checkPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	conf := watchPath{
+		root:      path,
+		include:   opts.Include,
+		exclude:   opts.Exclude,
+		ops:       opts.Ops,
+		recursive: opts.Recursive,
+		skipDirs:  opts.SkipDirs,
+		skipFunc:  opts.SkipDir,
+		filter:    opts.Filter,
+		poll:      opts.PollInterval,
+	}
+	if conf.ops == 0 {
+		conf.ops = AllOps
+	}
+	if len(opts.IgnoreFiles) > 0 {
+		conf.ignores = newIgnoreSet(path, opts.IgnoreFiles)
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if opts.Notify != nil {
+		conf.handler = fw.addHandler(opts.Notify)
+	}
+	err := fw.addDirs(path, conf)
+	if err != nil && conf.handler != 0 {
+		fw.removeHandler(conf.handler)
+	}
+	return err
+}
+
+// FileOptions describes how a file added with AddFileOptions is watched.
+type FileOptions struct {
+	// Ops are the operations to watch. AllOps is used if it is zero.
+	Ops Op
+
+	// Persistent keeps the file watched after it is removed or renamed, so
+	// that events are delivered again once it is created again, as happens
+	// with log rotation. The Create event when it comes back has the time it
+	// was missing for in Event.Gap. The file is watched through the directory
+	// it is in, or the nearest one above it if that is removed.
+	Persistent bool
+
+	// AllowMissing lets the file be added before it exists, along with any
+	// of the directories above it. It is watched through the nearest
+	// directory above it that does exist, moving down as the others are
+	// created, and a Create is sent once the file itself is. From then on it
+	// is watched as if Persistent were set.
+	AllowMissing bool
+
+	// PollInterval, if greater than zero, has the file polled that often
+	// instead of relying on notifications, as with WithPolling.
+	PollInterval time.Duration
+
+	// Notify, if set, is called with the events for this file alone, as with
+	// AddFileNotify.
+	Notify func(*Event, error)
+}
+
+// AddFileOptions adds a file to be watched as described by opts, returning an
+// error if any. It is like AddFile, but allows the file to be watched
+// persistently, or before it exists.
+func (fw *FileSystemWatcher) AddFileOptions(path string, opts FileOptions) error {
+	conf := watchPath{root: path, ops: opts.Ops, poll: opts.PollInterval}
+	if conf.ops == 0 {
+		conf.ops = AllOps
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if opts.Notify != nil {
+		conf.handler = fw.addHandler(opts.Notify)
+	}
+	var err error
+	if opts.Persistent || opts.AllowMissing {
+		err = fw.addPersistent(path, conf, opts.AllowMissing)
+	} else {
+		err = fw.addFile(path, conf)
+	}
+	if err != nil && conf.handler != 0 {
+		fw.removeHandler(conf.handler)
+	}
+	return err
+}
+
+// checkPattern returns an error if pattern is malformed.
+func checkPattern(pattern string) error {
+	if isPathPattern(pattern) {
+		for _, elem := range strings.Split(pattern, "/") {
+			if _, err := path.Match(elem, ""); err != nil {
+				return fmt.Errorf("Bad pattern %q: %s", pattern, err)
+			}
+		}
+		return nil
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Bad pattern %q: %s", pattern, err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Make sure include and exclude patterns are combined properly.
+func TestMatchPatternIncludeExclude(t *testing.T) {
+	p := &watchPath{
+		path:    "root",
+		root:    "root",
+		isdir:   true,
+		include: []string{"*.go", "*.tmpl"},
+		exclude: []string{"*_test.go", "vendor/**"},
+	}
+	tests := []struct {
+		name  string
+		match bool
+	}{
+		{"main.go", true},
+		{"page.tmpl", true},
+		{"main_test.go", false},
+		{"README.md", false},
+		{"vendor/lib/lib.go", false},
+		{"pkg/lib.go", true},
+	}
+	for _, test := range tests {
+		if p.matchPattern(filepath.Join("root", test.name)) != test.match {
+			t.Fatalf("matchPattern(%q) should be %v", test.name, test.match)
+		}
+	}
+
+	// With only excludes, everything else is allowed.
+	p.include = nil
+	if !p.matchPattern(filepath.Join("root", "README.md")) {
+		t.Fatal("matchPattern should allow files that are not excluded")
+	}
+}
+
+// Make sure AddDirOptions rejects malformed patterns.
+func TestAddDirOptionsBadPattern(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := newFakeWatcher(t)
+	defer fw.Close()
+
+	for _, opts := range []DirOptions{
+		{Include: []string{"*.go", "[a-"}},
+		{Exclude: []string{"src/**/[a-"}},
+		{SkipDirs: []string{"[a-"}},
+	} {
+		if err := fw.AddDirOptions(dir, opts); err == nil {
+			t.Fatal("AddDirOptions should not allow malformed patterns:", opts)
+		}
+	}
+	if fw.watchPaths.len() != 0 {
+		t.Fatal("AddDirOptions added a path despite failing")
+	}
+}
+
+// Make sure AddDirOptions filters events with its patterns.
+func TestAddDirOptions(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDirOptions(dir, DirOptions{
+		Include: []string{"*.go", "*.tmpl"},
+		Exclude: []string{"*_test.go"},
+		Ops:     Create,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	var events []Event
+	for _, name := range []string{"main_test.go", "README.md", "main.go", "page.tmpl"} {
+		name = filepath.Join(dir, name)
+		if filepath.Ext(name) != ".md" && filepath.Base(name) != "main_test.go" {
+			want = append(want, name)
+		}
+		ioutil.WriteFile(name, []byte("test"), 0700)
+		events = append(events, Event{Name: name, Op: Create})
+	}
+	send(b, events...)
+
+	for _, name := range want {
+		if event := waitEvent(t, fw); event.Name != name {
+			t.Fatal("Notified of wrong file:", event)
+		}
+	}
+}
+
+// Make sure skipped directories are never watched, whether they are there
+// when the directory is added or created later.
+func TestAddDirOptionsSkipDirs(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "node_modules", "lib"), 0700)
+	os.MkdirAll(filepath.Join(dir, "build", "out"), 0700)
+	os.MkdirAll(filepath.Join(dir, "src"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	var mu sync.Mutex
+	var asked []string
+	err := fw.AddDirOptions(dir, DirOptions{
+		Recursive: true,
+		SkipDirs:  []string{"node_modules"},
+		SkipDir: func(path string, info os.FileInfo) bool {
+			mu.Lock()
+			asked = append(asked, path)
+			mu.Unlock()
+			return info.Name() == "build"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skipped := range []string{"node_modules", "node_modules/lib", "build", "build/out"} {
+		if fw.watchPaths.get(filepath.Join(dir, skipped)) != nil {
+			t.Fatal("Skipped directory is watched:", skipped)
+		}
+	}
+	if fw.watchPaths.get(filepath.Join(dir, "src")) == nil {
+		t.Fatal("Directory that is not skipped is not watched")
+	}
+	mu.Lock()
+	for _, path := range asked {
+		if filepath.Base(filepath.Dir(path)) == "node_modules" || filepath.Base(filepath.Dir(path)) == "build" {
+			t.Fatal("SkipDir was asked about a directory beneath a skipped one:", path)
+		}
+	}
+	mu.Unlock()
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	// Directories created later are skipped in the same way.
+	modules := filepath.Join(dir, "src", "node_modules")
+	lib := filepath.Join(dir, "src", "lib")
+	os.Mkdir(modules, 0700)
+	os.Mkdir(lib, 0700)
+	// The watcher takes one event at a time, so both directories have been
+	// dealt with once the file after them is delivered.
+	marker := filepath.Join(dir, "src", "main.go")
+	ioutil.WriteFile(marker, []byte("test"), 0700)
+	send(b, Event{Name: modules, Op: Create}, Event{Name: lib, Op: Create}, Event{Name: marker, Op: Create})
+	for done := false; !done; {
+		select {
+		case event := <-events:
+			done = event.Name == marker
+		case <-time.After(time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	if fw.watchPaths.get(lib) == nil || !b.Watching(lib) {
+		t.Fatal("Directory created later was not watched")
+	}
+	if fw.watchPaths.get(modules) != nil || b.Watching(modules) {
+		t.Fatal("Skipped directory created later is watched")
+	}
+}
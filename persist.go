@@ -0,0 +1,216 @@
+package bcnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// addPersistent adds a file to watch through the directory it is in, so that
+// it is still watched after it is removed and created again. If allowMissing
+// is set, the file and the directories above it do not need to exist yet, and
+// it is watched through the nearest directory that does. fw.mu must be held.
+func (fw *FileSystemWatcher) addPersistent(path string, conf watchPath, allowMissing bool) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("Use AddDir instead for %s", path)
+	} else if err != nil && !(allowMissing && os.IsNotExist(err)) {
+		return stackerr.Wrap(err)
+	}
+	dir := nearestDir(path)
+	if err := fw.addWatch(dir, conf.poll); err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// A watch on the file itself would report everything a second time.
+	if old := fw.watchPaths.get(filepath.Clean(path)); old != nil && !old.isdir && !old.persistent {
+		fw.removeWatch(path)
+	}
+	conf.path = path
+	conf.persistent = true
+	fw.replace(conf)
+	fw.anchor(dir, path)
+	return nil
+}
+
+// anchor records that the directory dir is watched for the sake of the file
+// at path, in place of any directory that was watched for it before. fw.mu
+// must be held.
+func (fw *FileSystemWatcher) anchor(dir, path string) {
+	dir, path = filepath.Clean(dir), filepath.Clean(path)
+	if fw.anchorOf[path] == dir {
+		return
+	}
+	fw.unanchor(path)
+	if fw.anchors[dir] == nil {
+		fw.anchors[dir] = make(map[string]struct{})
+	}
+	fw.anchors[dir][path] = struct{}{}
+	fw.anchorOf[path] = dir
+}
+
+// unanchor forgets the directory watched for the sake of the file at path,
+// and stops watching the directory if nothing else needs it. fw.mu must be
+// held.
+func (fw *FileSystemWatcher) unanchor(path string) {
+	path = filepath.Clean(path)
+	dir, ok := fw.anchorOf[path]
+	if !ok {
+		return
+	}
+	delete(fw.anchorOf, path)
+	files := fw.anchors[dir]
+	delete(files, path)
+	if len(files) > 0 {
+		return
+	}
+	delete(fw.anchors, dir)
+	if fw.watchPaths.get(dir) == nil {
+		fw.removeWatch(dir)
+	}
+}
+
+// reanchor watches the file at path through the nearest directory above it
+// that exists, which changes as directories are created and removed. fw.mu
+// must be held.
+func (fw *FileSystemWatcher) reanchor(path string) error {
+	for {
+		dir := nearestDir(path)
+		if fw.anchorOf[filepath.Clean(path)] == dir {
+			return nil
+		}
+		var interval time.Duration
+		if p := fw.watchPaths.get(filepath.Clean(path)); p != nil {
+			interval = p.poll
+		}
+		if err := fw.addWatch(dir, interval); err != nil {
+			// Try again further up if the directory has gone in the meantime.
+			if !isDirNow(dir) {
+				continue
+			}
+			return stackerr.Wrap(err)
+		}
+		fw.anchor(dir, path)
+		// More may have been created before the watch was in place.
+		if nearestDir(path) == dir {
+			return nil
+		}
+	}
+}
+
+// nearestDir returns the closest directory above path that exists.
+func nearestDir(path string) string {
+	dir := filepath.Dir(filepath.Clean(path))
+	for !isDirNow(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+// descend moves the watches for persistent files beneath a directory that
+// has just been created down to it, or further if more has been created
+// already. A Create is queued for any of the files that are already there,
+// since there will be no event for them.
+func (fw *FileSystemWatcher) descend(created string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	created = filepath.Clean(created)
+	prefix := created + string(filepath.Separator)
+	var found []queued
+	for _, path := range fw.anchored(filepath.Dir(created)) {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if err := fw.reanchor(path); err != nil {
+			found = append(found, queued{err: err})
+			continue
+		}
+		if exists(path) {
+			found = append(found, queued{event: fsnotify.Event{Name: path, Op: fsnotify.Create}, synthetic: true})
+		}
+	}
+	fw.pushPending(found...)
+}
+
+// ascend moves the watches for persistent files up from a directory that has
+// just been removed or renamed, to the nearest directory that is left.
+func (fw *FileSystemWatcher) ascend(removed string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var found []queued
+	for _, path := range fw.anchored(filepath.Clean(removed)) {
+		// The watch on the directory is of no use any more, even if it has
+		// been created again already.
+		fw.unanchor(path)
+		if err := fw.reanchor(path); err != nil {
+			found = append(found, queued{err: err})
+			continue
+		}
+		// The directories may have been created again already.
+		if exists(path) {
+			found = append(found, queued{event: fsnotify.Event{Name: path, Op: fsnotify.Create}, synthetic: true})
+		}
+	}
+	fw.pushPending(found...)
+}
+
+// anchored returns the files that dir is watched for. fw.mu must be held.
+func (fw *FileSystemWatcher) anchored(dir string) []string {
+	var files []string
+	for path := range fw.anchors[dir] {
+		files = append(files, path)
+	}
+	return files
+}
+
+// unwatch removes the watch fsnotify has on path unless it is still needed
+// for a file watched with FileOptions.Persistent. fw.mu must be held.
+func (fw *FileSystemWatcher) unwatch(path string) error {
+	if len(fw.anchors[filepath.Clean(path)]) > 0 {
+		return nil
+	}
+	return fw.removeWatch(path)
+}
+
+// trackGap keeps note of when a file watched with FileOptions.Persistent goes
+// missing, and returns how long it was missing for when it comes back.
+func (fw *FileSystemWatcher) trackGap(p *watchPath, event fsnotify.Event) time.Duration {
+	if !p.persistent || filepath.Clean(event.Name) != filepath.Clean(p.path) {
+		return 0
+	}
+	key := filepath.Clean(p.path)
+
+	fw.goneMu.Lock()
+	defer fw.goneMu.Unlock()
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if _, ok := fw.gone[key]; !ok {
+			fw.gone[key] = time.Now()
+		}
+		return 0
+	}
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if since, ok := fw.gone[key]; ok {
+			delete(fw.gone, key)
+			return time.Since(since)
+		}
+	}
+	return 0
+}
+
+// forgetGap drops any note of the file at path having gone missing.
+func (fw *FileSystemWatcher) forgetGap(path string) {
+	fw.goneMu.Lock()
+	delete(fw.gone, filepath.Clean(path))
+	fw.goneMu.Unlock()
+}
@@ -0,0 +1,154 @@
+package bcnotify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure a persistent file is still watched after it is removed and created
+// again, and that nothing else in its directory is reported.
+func TestAddFileOptionsPersistent(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(file, []byte("one\n"), 0700)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddFileOptions(file, FileOptions{Persistent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	wait := func(op Op) *Event {
+		select {
+		case event := <-events:
+			if event.Name != file || event.Op != op {
+				t.Fatalf("Wanted %s got %s", op, event)
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", op)
+		}
+		return nil
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "other.log"), []byte("other\n"), 0700)
+	appendFile(t, file, "two\n")
+	wait(Write)
+
+	// Rotate the log.
+	os.Rename(file, file+".1")
+	wait(Rename)
+	time.Sleep(20 * time.Millisecond)
+	ioutil.WriteFile(file, nil, 0700)
+	if event := wait(Create); event.Gap < 20*time.Millisecond {
+		t.Fatal("Wanted a gap of at least 20ms got", event.Gap)
+	}
+	appendFile(t, file, "three\n")
+	wait(Write)
+
+	// Removing the file stops the directory being watched as well.
+	if err := fw.RemoveFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(fw.anchors) != 0 {
+		t.Fatal("Directory is still watched for the file:", fw.anchors)
+	}
+	appendFile(t, file, "four\n")
+	select {
+	case event := <-events:
+		t.Fatal("Got an event after the file was removed:", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// appendFile adds data to the end of the file at path with a single write.
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Make sure a file can be added before it or the directories above it exist,
+// and that a Create is sent when it appears.
+func TestAddFileOptionsAllowMissing(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	file := filepath.Join(a, "b", "ready")
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	if err := fw.AddFileOptions(file, FileOptions{}); err == nil {
+		t.Fatal("AddFileOptions should fail for a missing file without AllowMissing")
+	}
+	err := fw.AddFileOptions(file, FileOptions{Ops: Create | Remove, AllowMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	wait := func(op Op) {
+		select {
+		case event := <-events:
+			if event.Name != file || event.Op != op {
+				t.Fatalf("Wanted %s got %s", op, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", op)
+		}
+	}
+
+	// One directory at a time.
+	os.Mkdir(a, 0700)
+	time.Sleep(20 * time.Millisecond)
+	os.Mkdir(filepath.Dir(file), 0700)
+	time.Sleep(20 * time.Millisecond)
+	ioutil.WriteFile(file, nil, 0700)
+	wait(Create)
+
+	// Removing the directories moves the watch back up.
+	os.RemoveAll(a)
+	wait(Remove)
+
+	// And all at once, which races the watch moving down.
+	os.MkdirAll(filepath.Dir(file), 0700)
+	ioutil.WriteFile(file, nil, 0700)
+	wait(Create)
+
+	select {
+	case event := <-events:
+		t.Fatal("Got an extra event:", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
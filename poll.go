@@ -0,0 +1,375 @@
+package bcnotify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// WithPolling makes the FileSystemWatcher find changes by looking at every
+// watched path once per interval, instead of being told about them by the
+// operating system. This works on file systems that do not send
+// notifications, such as NFS, SMB and many FUSE mounts, at the cost of
+// noticing changes later and of the work of looking.
+//
+// Changes found by polling are reported with the same events as usual. A file
+// that is renamed within a directory is reported as a Rename and a Create, but
+// a file that is written to without its size or modification time changing
+// cannot be noticed, and a touch is reported as a Write rather than a Chmod.
+// A file created between two looks in place of one that was removed may be
+// taken for the same file renamed, if it was given the same inode.
+//
+// Single paths can be polled instead with DirOptions.PollInterval and
+// FileOptions.PollInterval.
+func WithPolling(interval time.Duration) Option {
+	// Each watcher needs a Backend of its own, so make it when the option is
+	// used rather than when it is made.
+	return func(fw *FileSystemWatcher) {
+		fw.watcher = NewPollingBackend(interval)
+	}
+}
+
+// addWatch starts watching path, by polling it if interval is greater than
+// zero, or through the Backend otherwise.
+func (fw *FileSystemWatcher) addWatch(path string, interval time.Duration) error {
+	if interval > 0 {
+		return fw.poller.Add(path, interval)
+	}
+	if err := fw.watcher.Add(path); err != nil {
+		return fw.watchLimited(path, err)
+	}
+	// It may have been polled before, such as when the limit on watches was
+	// reached, but the Backend has it now.
+	if fw.poller.has(path) {
+		fw.poller.Remove(path)
+	}
+	return nil
+}
+
+// removeWatch stops watching path, whichever way it is watched.
+func (fw *FileSystemWatcher) removeWatch(path string) error {
+	if fw.poller.has(path) {
+		return fw.poller.Remove(path)
+	}
+	return fw.watcher.Remove(path)
+}
+
+// polled is a path watched by a poller, with what was found the last time it
+// was looked at.
+type polled struct {
+	interval time.Duration
+	next     time.Time              // when to look at it again
+	self     os.FileInfo            // the path itself
+	entries  map[string]os.FileInfo // what is in it, if it is a directory
+}
+
+// poller finds changes to paths by looking at them regularly. It sends the
+// same events as fsnotify would for the paths.
+type poller struct {
+	events chan Event
+	errors chan error
+
+	mu    sync.Mutex
+	paths map[string]*polled
+
+	wake chan struct{} // tells the loop that the paths have changed
+	done chan struct{}
+	once sync.Once
+}
+
+// newPoller returns a poller that is watching nothing yet.
+func newPoller() *poller {
+	p := &poller{
+		events: make(chan Event),
+		errors: make(chan error),
+		paths:  make(map[string]*polled),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+// Add starts polling path every interval. If it is already being polled, only
+// its interval is changed.
+func (p *poller) Add(path string, interval time.Duration) error {
+	path = filepath.Clean(path)
+	self, entries, err := snapshot(path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if old, ok := p.paths[path]; ok {
+		old.interval = interval
+		old.next = time.Now().Add(interval)
+	} else {
+		p.paths[path] = &polled{
+			interval: interval,
+			next:     time.Now().Add(interval),
+			self:     self,
+			entries:  entries,
+		}
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Remove stops polling path.
+func (p *poller) Remove(path string) error {
+	path = filepath.Clean(path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.paths[path]; !ok {
+		return fmt.Errorf("Can't stop polling %s, which is not being polled", path)
+	}
+	delete(p.paths, path)
+	return nil
+}
+
+// Events returns the channel that events are sent on.
+func (p *poller) Events() <-chan Event {
+	return p.events
+}
+
+// Errors returns the channel that errors are sent on.
+func (p *poller) Errors() <-chan error {
+	return p.errors
+}
+
+// has returns whether path is being polled.
+func (p *poller) has(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.paths[filepath.Clean(path)]
+	return ok
+}
+
+// Close stops polling everything. The channels are closed once the loop has
+// finished.
+func (p *poller) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// loop looks at each path when it is due until the poller is closed.
+func (p *poller) loop() {
+	defer close(p.errors)
+	defer close(p.events)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		wait := time.Hour
+		var due []string
+		p.mu.Lock()
+		for path, w := range p.paths {
+			if !w.next.After(now) {
+				due = append(due, path)
+				w.next = now.Add(w.interval)
+			}
+			if d := w.next.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		p.mu.Unlock()
+
+		for _, path := range due {
+			if !p.poll(path) {
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// poll looks at path and sends an event for everything that has changed since
+// it was last looked at. It returns false if the poller was closed.
+func (p *poller) poll(path string) bool {
+	p.mu.Lock()
+	w, ok := p.paths[path]
+	var old polled
+	if ok {
+		old = *w
+	}
+	p.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	self, entries, err := snapshot(path)
+	if err != nil && !os.IsNotExist(err) {
+		return p.send(nil, stackerr.Wrap(err))
+	}
+
+	var events []Event
+	if err != nil {
+		// Gone, which fsnotify reports for everything that was in it and
+		// then for the path itself before it stops watching it.
+		events = append(diff(path, old.entries, nil), Event{Name: path, Op: Remove})
+	} else {
+		if op := changed(old.self, self); op != 0 {
+			events = append(events, Event{Name: path, Op: op})
+		}
+		events = append(events, diff(path, old.entries, entries)...)
+	}
+
+	p.mu.Lock()
+	if p.paths[path] == w {
+		if err != nil {
+			delete(p.paths, path)
+		} else {
+			w.self = self
+			w.entries = entries
+		}
+	}
+	p.mu.Unlock()
+
+	for i := range events {
+		if !p.send(&events[i], nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// send hands on an event or an error, returning false if the poller was
+// closed first.
+func (p *poller) send(event *Event, err error) bool {
+	if err != nil {
+		select {
+		case p.errors <- err:
+			return true
+		case <-p.done:
+			return false
+		}
+	}
+	select {
+	case p.events <- *event:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// snapshot returns the info for path and, if it is a directory, for each
+// entry in it.
+func snapshot(path string) (os.FileInfo, map[string]os.FileInfo, error) {
+	self, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !self.IsDir() {
+		return self, nil, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make(map[string]os.FileInfo, len(infos))
+	for _, info := range infos {
+		entries[info.Name()] = info
+	}
+	return self, entries, nil
+}
+
+// changed returns the operation that turned before into after, or 0 if
+// nothing changed. The contents of directories are looked at separately, so
+// only their permissions are compared.
+func changed(before, after os.FileInfo) Op {
+	if !after.IsDir() && (before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) || !os.SameFile(before, after)) {
+		return Write
+	}
+	if before.Mode() != after.Mode() {
+		return Chmod
+	}
+	return 0
+}
+
+// diff returns the events that turn the entries of dir in before into those in
+// after. As with fsnotify, an entry that was renamed is reported as a Rename
+// of the old name followed straight away by a Create of the new one.
+func diff(dir string, before, after map[string]os.FileInfo) []Event {
+	var events []Event
+	created := make(map[string]bool)
+	var createdNames []string // the same, in order
+	for _, name := range sortedNames(after) {
+		if _, ok := before[name]; !ok {
+			created[name] = true
+			createdNames = append(createdNames, name)
+		}
+	}
+
+	for _, name := range sortedNames(before) {
+		info := before[name]
+		now, ok := after[name]
+		if ok {
+			if op := changed(info, now); op != 0 {
+				events = append(events, Event{Name: filepath.Join(dir, name), Op: op})
+			}
+			continue
+		}
+		// Look for the same file under a new name.
+		renamed := ""
+		for _, newName := range createdNames {
+			if created[newName] && os.SameFile(info, after[newName]) {
+				renamed = newName
+				break
+			}
+		}
+		if renamed == "" {
+			events = append(events, Event{Name: filepath.Join(dir, name), Op: Remove})
+			continue
+		}
+		delete(created, renamed)
+		events = append(events,
+			Event{Name: filepath.Join(dir, name), Op: Rename},
+			Event{Name: filepath.Join(dir, renamed), Op: Create})
+	}
+
+	for _, name := range createdNames {
+		if created[name] {
+			events = append(events, Event{Name: filepath.Join(dir, name), Op: Create})
+		}
+	}
+	return events
+}
+
+// sortedNames returns the names in entries in order, so that events come out
+// in the same order every time.
+func sortedNames(entries map[string]os.FileInfo) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,193 @@
+package bcnotify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Make sure diff finds every kind of change between two listings.
+func TestPollDiff(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"kept", "written", "removed", "renamed"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("test"), 0600)
+	}
+	_, before, err := snapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create before removing, so that the new file cannot reuse the inode of
+	// the removed one and look like it was renamed.
+	ioutil.WriteFile(filepath.Join(dir, "created"), []byte("test"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "written"), []byte("more test"), 0600)
+	os.Remove(filepath.Join(dir, "removed"))
+	os.Rename(filepath.Join(dir, "renamed"), filepath.Join(dir, "moved"))
+	_, after, err := snapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Name: filepath.Join(dir, "removed"), Op: Remove},
+		{Name: filepath.Join(dir, "renamed"), Op: Rename},
+		{Name: filepath.Join(dir, "moved"), Op: Create},
+		{Name: filepath.Join(dir, "written"), Op: Write},
+		{Name: filepath.Join(dir, "created"), Op: Create},
+	}
+	if got := diff(dir, before, after); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wanted %v got %v", want, got)
+	}
+	if got := diff(dir, after, after); len(got) != 0 {
+		t.Fatal("Wanted no events for an unchanged directory got", got)
+	}
+}
+
+// Make sure a watcher that polls sends the same events as one that does not.
+func TestWithPolling(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher(WithPolling(10 * time.Millisecond))
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", AllOps, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := fw.watcher.(*pollingBackend); !ok || !b.has(dir) {
+		t.Fatal("Directory is not polled")
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	wait := func(name string, op Op) {
+		select {
+		case event := <-events:
+			if event.Name != name || event.Op != op {
+				t.Fatalf("Wanted %q: %s got %s", name, op, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %q: %s", name, op)
+		}
+	}
+
+	file := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(file, []byte("test"), 0600)
+	wait(file, Create)
+
+	appendFile(t, file, "more")
+	wait(file, Write)
+
+	moved := filepath.Join(dir, "moved.txt")
+	os.Rename(file, moved)
+	wait(file, Rename)
+	wait(moved, Create)
+
+	os.Remove(moved)
+	wait(moved, Remove)
+
+	// New directories are polled too.
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0700)
+	wait(sub, Create)
+	subFile := filepath.Join(sub, "test.txt")
+	ioutil.WriteFile(subFile, []byte("test"), 0600)
+	wait(subFile, Create)
+}
+
+// Make sure watchers made with the same WithPolling option each have their own
+// Backend.
+func TestWithPollingShared(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	opt := WithPolling(10 * time.Millisecond)
+	first, _ := NewFileSystemWatcher(opt)
+	defer first.Close()
+	second, _ := NewFileSystemWatcher(opt)
+	defer second.Close()
+
+	if first.watcher == second.watcher {
+		t.Fatal("Watchers share a Backend")
+	}
+
+	err := second.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	file := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(file, []byte("test"), 0600)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := second.WaitEventContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != file {
+		t.Fatal("Got the wrong event:", event)
+	}
+}
+
+// Make sure a single path can be polled by a watcher that does not otherwise
+// poll.
+func TestPollInterval(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(file, []byte("test"), 0600)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddFileOptions(file, FileOptions{PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fw.poller.has(file) {
+		t.Fatal("File is not polled")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		event, err := fw.WaitEvent()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if event.Name != file || event.Op != Write {
+			t.Error("Wanted a Write got", event)
+		}
+	}()
+
+	appendFile(t, file, "more")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+
+	if err := fw.RemoveFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if fw.poller.has(file) {
+		t.Fatal("File is still polled after it was removed")
+	}
+}
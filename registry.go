@@ -0,0 +1,101 @@
+package bcnotify
+
+import "path/filepath"
+
+// registry indexes watchPaths by their cleaned path so that finding the one
+// for an event does not depend on how many paths are watched.
+// It is not safe for concurrent use; FileSystemWatcher guards it with mu.
+type registry struct {
+	// paths maps a cleaned path to its watchPath. Entries are never changed
+	// once stored, only replaced, so they can be handed out freely.
+	paths map[string]*watchPath
+
+	// children maps a cleaned path to the cleaned paths one level below it that
+	// are either watched or have something watched beneath them. It lets the
+	// paths beneath a directory be found without looking at every entry.
+	children map[string]map[string]struct{}
+}
+
+// newRegistry returns an empty registry.
+func newRegistry() *registry {
+	return &registry{
+		paths:    make(map[string]*watchPath),
+		children: make(map[string]map[string]struct{}),
+	}
+}
+
+// len returns the number of watched paths.
+func (r *registry) len() int {
+	return len(r.paths)
+}
+
+// get returns the watchPath for a path that has already been cleaned, or nil.
+func (r *registry) get(clean string) *watchPath {
+	return r.paths[clean]
+}
+
+// add stores p, replacing anything already stored for the same path.
+func (r *registry) add(p watchPath) {
+	key := filepath.Clean(p.path)
+	r.paths[key] = &p
+
+	// Link the path to its parents until we reach one that is already linked.
+	for {
+		parent := filepath.Dir(key)
+		if parent == key {
+			return
+		}
+		siblings, linked := r.children[parent]
+		if !linked {
+			siblings = make(map[string]struct{})
+			r.children[parent] = siblings
+		}
+		siblings[key] = struct{}{}
+		if linked {
+			return
+		}
+		key = parent
+	}
+}
+
+// remove forgets the watchPath for path, if there is one.
+func (r *registry) remove(path string) {
+	key := filepath.Clean(path)
+	if _, ok := r.paths[key]; !ok {
+		return
+	}
+	delete(r.paths, key)
+
+	// Unlink the path and any parents that no longer lead to anything watched.
+	for {
+		if _, watched := r.paths[key]; watched || len(r.children[key]) > 0 {
+			return
+		}
+		parent := filepath.Dir(key)
+		if parent == key {
+			return
+		}
+		delete(r.children[parent], key)
+		if len(r.children[parent]) == 0 {
+			delete(r.children, parent)
+		}
+		key = parent
+	}
+}
+
+// subtree returns the watchPaths for path and everything beneath it.
+func (r *registry) subtree(path string) []*watchPath {
+	var paths []*watchPath
+	stack := []string{filepath.Clean(path)}
+	for len(stack) > 0 {
+		key := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if p, ok := r.paths[key]; ok {
+			paths = append(paths, p)
+		}
+		for child := range r.children[key] {
+			stack = append(stack, child)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,96 @@
+package bcnotify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Make sure subtree finds everything beneath a path, even when the
+// directories in between are not watched themselves.
+func TestRegistrySubtree(t *testing.T) {
+	r := newRegistry()
+	for _, p := range []string{"a", "a/b", "a/b/c/d", "a/e/f", "ab", "x"} {
+		r.add(watchPath{path: filepath.FromSlash(p)})
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"a", []string{"a", "a/b", "a/b/c/d", "a/e/f"}},
+		{"a/b", []string{"a/b", "a/b/c/d"}},
+		{"a/b/c", []string{"a/b/c/d"}},
+		{"a/", []string{"a", "a/b", "a/b/c/d", "a/e/f"}},
+		{"none", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, p := range r.subtree(filepath.FromSlash(test.path)) {
+			got = append(got, filepath.ToSlash(p.path))
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Fatalf("subtree(%q): wanted %v got %v", test.path, test.want, got)
+		}
+	}
+}
+
+// Make sure removing paths does not leave anything behind in the index.
+func TestRegistryRemove(t *testing.T) {
+	r := newRegistry()
+	paths := []string{"a", "a/b", "a/b/c/d", "a/e/f"}
+	for _, p := range paths {
+		r.add(watchPath{path: filepath.FromSlash(p)})
+	}
+
+	r.remove(filepath.FromSlash("a/b"))
+	if r.get(filepath.FromSlash("a/b")) != nil {
+		t.Fatal("a/b was not removed")
+	}
+	if len(r.subtree(filepath.FromSlash("a/b/c"))) != 1 {
+		t.Fatal("removing a/b lost a/b/c/d")
+	}
+
+	for _, p := range paths {
+		r.remove(filepath.FromSlash(p))
+	}
+	if r.len() != 0 || len(r.children) != 0 {
+		t.Fatal("registry not empty:", r.paths, r.children)
+	}
+}
+
+// Make sure adding a path again replaces its configuration.
+func TestRegistryReplace(t *testing.T) {
+	r := newRegistry()
+	r.add(watchPath{path: "a", ops: Create})
+	r.add(watchPath{path: "a/", ops: Write})
+	if r.len() != 1 {
+		t.Fatal("wanted 1 path got", r.len())
+	}
+	if r.get("a").ops != Write {
+		t.Fatal("configuration was not replaced")
+	}
+}
+
+// Looking up the watchPath for an event should cost the same no matter how
+// many paths are watched.
+func BenchmarkFindWatchPath(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			fw := &FileSystemWatcher{watchPaths: newRegistry()}
+			for i := 0; i < n; i++ {
+				dir := filepath.Join("root", fmt.Sprint(i%100), fmt.Sprint(i))
+				fw.watchPaths.add(watchPath{path: dir, root: "root", ops: AllOps, isdir: true})
+			}
+			name := filepath.Join("root", fmt.Sprint((n-1)%100), fmt.Sprint(n-1), "file.txt")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if fw.findWatchPath(name) == nil {
+					b.Fatal("no watchPath found")
+				}
+			}
+		})
+	}
+}
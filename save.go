@@ -0,0 +1,158 @@
+package bcnotify
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// atomicSaveWindow is how long to wait for a file added with AddFile to come
+// back after it was removed or renamed. Editors that save by renaming the old
+// file out of the way or a new one over it recreate the file straight away.
+var atomicSaveWindow = 50 * time.Millisecond
+
+// atomicSave recognises a file added with AddFile being replaced by a new one,
+// as editors do when they save by writing a new file and renaming it over the
+// old one, or by renaming the old one out of the way first. The watch is moved
+// to the new file and the event is reported as a Write to the original path.
+// It returns false if event is not part of such a save. A Remove or Rename
+// that may be is held back for settleSaves, and reported as nothing for now.
+func (fw *FileSystemWatcher) atomicSave(event fsnotify.Event) (*Event, bool) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename|fsnotify.Chmod) == 0 {
+		return nil, false
+	}
+	p := fw.findWatchPath(event.Name)
+	if p == nil || p.isdir || p.file == nil || filepath.Clean(p.path) != filepath.Clean(event.Name) {
+		return nil, false
+	}
+
+	// Events for the old file can still be on their way once the watch has
+	// been moved, such as its removal, or a Chmod when a backup of it is
+	// deleted.
+	if time.Since(p.armed) < atomicSaveWindow {
+		if i, err := os.Stat(event.Name); err == nil && os.SameFile(i, p.file) {
+			return nil, true
+		}
+	}
+
+	if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+		// Renaming a new file over the watched one only changes the link
+		// count of the old one, which comes through as a Chmod. It is not
+		// removed until nothing has it open any more.
+		i, err := os.Stat(event.Name)
+		if err != nil || os.SameFile(i, p.file) {
+			return nil, false
+		}
+		return fw.saved(p, event.Name, i)
+	}
+
+	// The new file may not be there yet. Rather than wait for it here and
+	// hold up every other event, the event is held back until the file
+	// appears or atomicSaveWindow has passed.
+	if i, err := os.Stat(event.Name); err == nil && !i.IsDir() {
+		return fw.saved(p, event.Name, i)
+	}
+	fw.pendingMu.Lock()
+	fw.saves = append(fw.saves, heldSave{event: event, deadline: time.Now().Add(atomicSaveWindow)})
+	fw.pendingMu.Unlock()
+	return nil, true
+}
+
+// saved moves the watch of p on to the file described by info, which is now
+// at name, and returns the Write to report for it. It returns false if p is
+// no longer watched.
+func (fw *FileSystemWatcher) saved(p *watchPath, name string, info os.FileInfo) (*Event, bool) {
+	if !fw.rearm(p, info) {
+		return nil, false
+	}
+	return fw.filter(fsnotify.Event{Name: name, Op: fsnotify.Write}, nil), true
+}
+
+// heldSave is a Remove or Rename of a file added with AddFile that may be
+// the first half of an atomic save.
+type heldSave struct {
+	event    fsnotify.Event
+	deadline time.Time // when to give up on the file coming back
+}
+
+// holdingSaves returns whether any events are held back by atomicSave.
+func (fw *FileSystemWatcher) holdingSaves() bool {
+	fw.pendingMu.Lock()
+	defer fw.pendingMu.Unlock()
+	return len(fw.saves) > 0
+}
+
+// settleSaves decides what to do with the events held back by atomicSave and
+// returns what to queue for those it has decided on. Once the file has come
+// back, that is a Write for it. Once atomicSaveWindow has passed it is the
+// original event, to be handled as usual. If name is not empty, only the
+// event held for that path is settled, whether or not its time is up, since
+// another event for it has arrived.
+func (fw *FileSystemWatcher) settleSaves(name string) []queued {
+	fw.pendingMu.Lock()
+	saves := fw.saves
+	fw.saves = nil
+	fw.pendingMu.Unlock()
+	if len(saves) == 0 {
+		return nil
+	}
+
+	var settled []queued
+	var held []heldSave
+	now := time.Now()
+	for _, h := range saves {
+		if name != "" && filepath.Clean(name) != filepath.Clean(h.event.Name) {
+			held = append(held, h)
+			continue
+		}
+		if i, err := os.Stat(h.event.Name); err == nil && !i.IsDir() {
+			p := fw.findWatchPath(h.event.Name)
+			if p != nil && filepath.Clean(p.path) == filepath.Clean(h.event.Name) {
+				if e, ok := fw.saved(p, h.event.Name, i); ok {
+					if e != nil {
+						e.describe()
+						settled = append(settled, queued{ready: e})
+					}
+					continue
+				}
+			}
+		} else if name == "" && now.Before(h.deadline) {
+			held = append(held, h)
+			continue
+		}
+		settled = append(settled, queued{event: h.event, held: true})
+	}
+
+	// atomicSave may have held back more while the lock was let go.
+	fw.pendingMu.Lock()
+	fw.saves = append(held, fw.saves...)
+	fw.pendingMu.Unlock()
+	return settled
+}
+
+// rearm moves the watch for the file watched by p on to the file described by
+// info, which has replaced it. It returns false if p is no longer watched.
+func (fw *FileSystemWatcher) rearm(p *watchPath, info os.FileInfo) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.watchPaths.get(filepath.Clean(p.path)) != p {
+		return false
+	}
+	// The old watch may still be on the file that was renamed out of the way,
+	// and fsnotify needs to forget it before the path can be watched again.
+	fw.removeWatch(p.path)
+	if err := fw.addWatch(p.path, p.poll); err != nil {
+		fw.pushPending(queued{err: stackerr.Wrap(err)})
+		return false
+	}
+	conf := *p
+	conf.file = info
+	conf.armed = time.Now()
+	fw.watchPaths.add(conf)
+	return true
+}
@@ -0,0 +1,146 @@
+package bcnotify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make sure saving a file the way editors do is reported as a single Write,
+// and that the file is still watched afterwards.
+func TestAtomicSave(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.txt")
+	ioutil.WriteFile(file, []byte("one"), 0700)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddFile(file, AllOps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- event
+	})
+
+	// wait waits for an event with op, and makes sure nothing else follows.
+	wait := func(what string, op Op) {
+		select {
+		case event := <-events:
+			if event.Op != op || event.Name != file {
+				t.Fatalf("Wanted %s after %s got %s", op, what, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event after", what)
+		}
+		select {
+		case event := <-events:
+			t.Fatalf("Got an extra event after %s: %s", what, event)
+		case <-time.After(2 * atomicSaveWindow):
+		}
+	}
+
+	// Write a new file and rename it over the old one.
+	tmp := filepath.Join(dir, ".test.txt.tmp")
+	ioutil.WriteFile(tmp, []byte("two"), 0700)
+	os.Rename(tmp, file)
+	wait("renaming a new file over it", Write)
+
+	// Rename the old file out of the way and write a new one.
+	backup := file + "~"
+	os.Rename(file, backup)
+	ioutil.WriteFile(tmp, []byte("three"), 0700)
+	os.Rename(tmp, file)
+	os.Remove(backup)
+	wait("renaming it out of the way", Write)
+
+	// The watch should be on the new file now.
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("four")
+	f.Close()
+	wait("writing to it", Write)
+
+	// Removing it for good is still a Remove.
+	os.Remove(file)
+	select {
+	case event := <-events:
+		if event.Op == Chmod {
+			event = <-events
+		}
+		if event.Op != Remove {
+			t.Fatal("Wanted REMOVE got", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the Remove")
+	}
+}
+
+// Make sure waiting to see whether a removed file comes back does not hold up
+// the events for anything else.
+func TestAtomicSaveHeld(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	const files = 40
+	var names []string
+	for i := 0; i < files; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("test%d.txt", i))
+		ioutil.WriteFile(name, []byte("test"), 0700)
+		if err := fw.AddFile(name, AllOps); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	// Removing every file but the last, then writing to the last, reports the
+	// Write straight away and each Remove once its file has not come back.
+	var events []Event
+	for _, name := range names[:files-1] {
+		os.Remove(name)
+		events = append(events, Event{Name: name, Op: Remove})
+	}
+	events = append(events, Event{Name: names[files-1], Op: Write})
+	start := time.Now()
+	send(b, events...)
+	if event := waitEvent(t, fw); event.Name != names[files-1] || event.Op != Write {
+		t.Fatal("Wanted the Write got", event)
+	}
+	for _, name := range names[:files-1] {
+		if event := waitEvent(t, fw); event.Name != name || event.Op != Remove {
+			t.Fatal("Wanted the Remove of", name, "got", event)
+		}
+	}
+	if took := time.Since(start); took > files/2*atomicSaveWindow {
+		t.Fatal("The Removes were waited for one at a time, taking", took)
+	}
+
+	// A file that comes back is reported as a Write, even with no event for
+	// it, and is still watched.
+	name := names[files-1]
+	os.Remove(name)
+	send(b, Event{Name: name, Op: Remove})
+	time.AfterFunc(atomicSaveWindow/5, func() {
+		ioutil.WriteFile(name, []byte("new"), 0700)
+	})
+	if event := waitEvent(t, fw); event.Name != name || event.Op != Write {
+		t.Fatal("Wanted a Write got", event)
+	}
+	if !b.Watching(name) {
+		t.Fatal("No longer watching", name)
+	}
+}
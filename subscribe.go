@@ -0,0 +1,347 @@
+package bcnotify
+
+import (
+	"context"
+	"sync"
+)
+
+// OverflowPolicy says what Subscribe does with an event or error when a
+// subscriber's buffer is full because it has fallen behind.
+type OverflowPolicy int
+
+const (
+	// Block waits for the subscriber to make room. Nothing is lost, but every
+	// other subscriber waits too.
+	Block OverflowPolicy = iota
+
+	// DropOldest throws away the oldest event in the buffer to make room.
+	DropOldest
+
+	// DropNewest throws away the event that does not fit.
+	DropNewest
+)
+
+// DefaultSubscribeBuffer is the number of events and errors buffered for each
+// subscriber by Subscribe.
+const DefaultSubscribeBuffer = 64
+
+// subscriber is a single consumer of the events read by the dispatcher.
+type subscriber struct {
+	filter func(Event) bool
+	policy OverflowPolicy
+	events chan Event
+	errors chan error
+
+	// done is closed when the subscriber is cancelled, to release the
+	// dispatcher if it is blocked sending to it.
+	done chan struct{}
+	once sync.Once
+
+	// mu is held while sending so that the channels are not closed under
+	// the dispatcher.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Subscribe returns channels that receive every event that passes filter, and
+// every error, along with a function to cancel the subscription. A nil filter
+// lets every event through. Every subscriber sees every event, unlike callers
+// of WaitEvent, which share them out between themselves.
+//
+// The channels are buffered with DefaultSubscribeBuffer and use the Block
+// policy when they are full. Use SubscribeBuffered to change either. Both
+// channels are closed when the subscription is cancelled or the watcher is
+// closed.
+func (fw *FileSystemWatcher) Subscribe(filter func(Event) bool) (<-chan Event, <-chan error, func()) {
+	return fw.SubscribeBuffered(filter, DefaultSubscribeBuffer, Block)
+}
+
+// SubscribeBuffered is like Subscribe with the buffer size and the policy for
+// when the subscriber falls behind given explicitly. The drop policies need
+// somewhere to drop from, so they always buffer at least one event.
+func (fw *FileSystemWatcher) SubscribeBuffered(filter func(Event) bool, size int, policy OverflowPolicy) (<-chan Event, <-chan error, func()) {
+	s := newSubscriber(filter, size, policy)
+	cancel := func() { fw.unsubscribe(s) }
+
+	fw.closedMu.Lock()
+	closed := fw.isclosed
+	fw.closedMu.Unlock()
+	if closed {
+		s.close()
+		return s.events, s.errors, cancel
+	}
+
+	fw.subsMu.Lock()
+	defer fw.subsMu.Unlock()
+	fw.subs = append(fw.subs, s)
+	if fw.stopDispatch == nil {
+		fw.startDispatch()
+	}
+	return s.events, s.errors, cancel
+}
+
+// newSubscriber returns a subscriber with the given filter, buffer size and
+// policy. The drop policies need somewhere to drop from, so they always buffer
+// at least one event.
+func newSubscriber(filter func(Event) bool, size int, policy OverflowPolicy) *subscriber {
+	if size < 1 && policy != Block {
+		size = 1
+	}
+	return &subscriber{
+		filter: filter,
+		policy: policy,
+		events: make(chan Event, size),
+		errors: make(chan error, size),
+		done:   make(chan struct{}),
+	}
+}
+
+// waitSubscription returns the subscriber that WaitEvent reads from while the
+// dispatcher is running, making it the first time. If the dispatcher is not
+// running it returns nil along with a channel that is closed when it starts.
+//
+// The subscriber uses the DropOldest policy, so that a caller that stops
+// calling WaitEvent, such as one that only wanted a single event or gave up
+// through WaitEventContext, never holds up the other subscribers.
+func (fw *FileSystemWatcher) waitSubscription() (*subscriber, <-chan struct{}) {
+	fw.subsMu.Lock()
+	defer fw.subsMu.Unlock()
+	if !fw.dispatching {
+		if fw.dispatchStarted == nil {
+			fw.dispatchStarted = make(chan struct{})
+		}
+		return nil, fw.dispatchStarted
+	}
+	if fw.waitSub == nil {
+		fw.waitSub = newSubscriber(nil, DefaultSubscribeBuffer, DropOldest)
+	}
+	return fw.waitSub, nil
+}
+
+// wait returns the next event or error sent to s. It returns false if s was
+// closed with nothing left in it.
+func (s *subscriber) wait(ctx context.Context) (*Event, error, bool) {
+	select {
+	case event, ok := <-s.events:
+		if ok {
+			return &event, nil, true
+		}
+	case err, ok := <-s.errors:
+		if ok {
+			return nil, err, true
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err(), true
+	}
+	// Both channels are closed together, but the other may still have
+	// something buffered.
+	select {
+	case event, ok := <-s.events:
+		if ok {
+			return &event, nil, true
+		}
+	default:
+	}
+	if err, ok := <-s.errors; ok {
+		return nil, err, true
+	}
+	return nil, nil, false
+}
+
+// unsubscribe removes s from the subscribers and closes its channels. The
+// dispatcher is stopped once nobody is left, so that WaitEvent goes back to
+// reading events itself.
+func (fw *FileSystemWatcher) unsubscribe(s *subscriber) {
+	s.close()
+
+	fw.subsMu.Lock()
+	defer fw.subsMu.Unlock()
+	for i, sub := range fw.subs {
+		if sub == s {
+			fw.subs = append(fw.subs[:i:i], fw.subs[i+1:]...)
+			break
+		}
+	}
+	if len(fw.subs) == 0 && fw.stopDispatch != nil {
+		fw.stopDispatch()
+		fw.stopDispatch = nil
+	}
+}
+
+// startDispatch starts the goroutine that reads events and hands them to the
+// subscribers. fw.subsMu must be held.
+func (fw *FileSystemWatcher) startDispatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	fw.stopDispatch = cancel
+
+	// Tell WaitEvent to read from the dispatcher from now on.
+	fw.dispatching = true
+	fw.dispatchGen++
+	gen := fw.dispatchGen
+	if fw.dispatchStarted != nil {
+		close(fw.dispatchStarted)
+		fw.dispatchStarted = nil
+	}
+
+	// Wait for any earlier dispatcher to finish so that two of them are never
+	// reading at the same time.
+	previous := fw.dispatchDone
+	done := make(chan struct{})
+	fw.dispatchDone = done
+
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		for {
+			event, err := fw.next(ctx, nil)
+			if err == ErrWatcherClosed {
+				// Anything that subscribes from now on gets a dispatcher of its
+				// own, which will close it straight away.
+				fw.subsMu.Lock()
+				subs := fw.subs
+				fw.subs = nil
+				if ctx.Err() == nil {
+					fw.stopDispatch()
+					fw.stopDispatch = nil
+				}
+				if w := fw.endDispatch(gen); w != nil {
+					subs = append(subs, w)
+				}
+				fw.subsMu.Unlock()
+				for _, s := range subs {
+					s.close()
+				}
+				return
+			}
+			if ctx.Err() != nil {
+				// Anything read as the dispatcher was stopped goes back on the
+				// queue for WaitEvent, after what it has been sent already.
+				if event != nil {
+					fw.unshiftPending(queued{ready: event})
+				} else if err != ctx.Err() {
+					fw.unshiftPending(queued{err: err})
+				}
+				fw.subsMu.Lock()
+				w := fw.endDispatch(gen)
+				fw.subsMu.Unlock()
+				if w != nil {
+					w.close()
+				}
+				return
+			}
+
+			fw.subsMu.Lock()
+			subs := make([]*subscriber, len(fw.subs), len(fw.subs)+1)
+			copy(subs, fw.subs)
+			if fw.waitSub != nil {
+				subs = append(subs, fw.waitSub)
+			}
+			fw.subsMu.Unlock()
+
+			for _, s := range subs {
+				if err != nil {
+					s.sendError(err)
+				} else {
+					s.sendEvent(*event)
+				}
+			}
+		}
+	}()
+}
+
+// endDispatch notes that the dispatcher started as gen has stopped, unless
+// another has been started since, and returns the subscriber WaitEvent was
+// reading from, for the caller to close. fw.subsMu must be held.
+func (fw *FileSystemWatcher) endDispatch(gen int) *subscriber {
+	if fw.dispatchGen != gen || fw.stopDispatch != nil {
+		return nil
+	}
+	fw.dispatching = false
+	w := fw.waitSub
+	fw.waitSub = nil
+	return w
+}
+
+// sendEvent hands event to the subscriber if it passes its filter.
+func (s *subscriber) sendEvent(event Event) {
+	if s.filter != nil && !s.filter(event) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+			default:
+			}
+		}
+	case DropNewest:
+		select {
+		case s.events <- event:
+		default:
+		}
+	default:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	}
+}
+
+// sendError hands err to the subscriber, following the same policy as for
+// events.
+func (s *subscriber) sendError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.errors <- err:
+				return
+			default:
+			}
+			select {
+			case <-s.errors:
+			default:
+			}
+		}
+	case DropNewest:
+		select {
+		case s.errors <- err:
+		default:
+		}
+	default:
+		select {
+		case s.errors <- err:
+		case <-s.done:
+		}
+	}
+}
+
+// close closes the subscriber's channels. It is safe to call more than once.
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.events)
+		close(s.errors)
+		s.mu.Unlock()
+	})
+}
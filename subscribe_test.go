@@ -0,0 +1,268 @@
+package bcnotify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Make sure every call to NotifyEvent sees every event.
+func TestNotifyEventFanOut(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	const consumers = 3
+	const files = 10
+	var wait sync.WaitGroup
+	wait.Add(consumers * files)
+	for i := 0; i < consumers; i++ {
+		fw.NotifyEvent(func(event *Event, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			wait.Done()
+		})
+	}
+
+	for i := 0; i < files; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("test%d.txt", i)), []byte("test"), 0700)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+// Make sure the filter and the overflow policies work.
+func TestSubscribe(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, filepath.Join(dir, fmt.Sprintf("test%d.txt", i)))
+	}
+
+	oldest, _, cancelOldest := fw.SubscribeBuffered(nil, 1, DropOldest)
+	defer cancelOldest()
+	newest, _, cancelNewest := fw.SubscribeBuffered(nil, 1, DropNewest)
+	defer cancelNewest()
+	filtered, _, cancelFiltered := fw.Subscribe(func(e Event) bool {
+		return e.Name == names[2]
+	})
+	defer cancelFiltered()
+	// Subscribers are sent events in the order they subscribed, so once this
+	// one has everything the others have been sent everything too.
+	all, _, cancelAll := fw.SubscribeBuffered(nil, 0, Block)
+	defer cancelAll()
+
+	for _, name := range names {
+		ioutil.WriteFile(name, []byte("test"), 0700)
+	}
+	for range names {
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+
+	if event := <-oldest; event.Name != names[len(names)-1] {
+		t.Fatal("DropOldest kept the wrong event:", event)
+	}
+	if event := <-newest; event.Name != names[0] {
+		t.Fatal("DropNewest kept the wrong event:", event)
+	}
+	if event := <-filtered; event.Name != names[2] {
+		t.Fatal("filter let the wrong event through:", event)
+	}
+	select {
+	case event := <-filtered:
+		t.Fatal("filter let an extra event through:", event)
+	default:
+	}
+}
+
+// Make sure the channels are closed on cancel and on Close.
+func TestSubscribeClose(t *testing.T) {
+	fw, _ := NewFileSystemWatcher()
+
+	events, errs, cancel := fw.Subscribe(nil)
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("events was not closed by cancel")
+	}
+	if _, ok := <-errs; ok {
+		t.Fatal("errors was not closed by cancel")
+	}
+	// Cancelling again should be harmless.
+	cancel()
+
+	events, _, cancel = fw.Subscribe(nil)
+	defer cancel()
+	fw.Close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("Got an event after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events was not closed by Close")
+	}
+
+	events, _, cancel = fw.Subscribe(nil)
+	defer cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("Subscribe after Close returned an open channel")
+	}
+}
+
+// Make sure WaitEvent still gets every event while there are subscribers, and
+// goes back to reading them itself once there are none.
+func TestWaitEventWithSubscribers(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.ini")
+	ioutil.WriteFile(config, []byte("test"), 0700)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan *Event, 10)
+	err = fw.AddFileNotify(config, Write, func(event *Event, err error) {
+		handled <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified int64
+	stop := fw.NotifyEventContext(context.Background(), func(event *Event, err error) {
+		atomic.AddInt64(&notified, 1)
+	})
+
+	const files = 20
+	var events []Event
+	for i := 0; i < files; i++ {
+		events = append(events, Event{Name: filepath.Join(dir, fmt.Sprintf("test%d.txt", i)), Op: Create})
+	}
+	events = append(events, Event{Name: config, Op: Write})
+	send(b, events...)
+	for _, want := range events {
+		if event := waitEvent(t, fw); event.Name != want.Name || event.Op != want.Op {
+			t.Fatal("Wanted", want, "got", event)
+		}
+	}
+
+	// Without the other subscribers, only the handler is left.
+	stop()
+	filename := filepath.Join(dir, "after.txt")
+	send(b, Event{Name: filename, Op: Create})
+	if event := waitEvent(t, fw); event.Name != filename {
+		t.Fatal("Got the wrong event:", event)
+	}
+
+	// And without any, WaitEvent reads the events itself.
+	if err := fw.RemoveFile(config); err != nil {
+		t.Fatal(err)
+	}
+	filename = filepath.Join(dir, "last.txt")
+	send(b, Event{Name: filename, Op: Create})
+	if event := waitEvent(t, fw); event.Name != filename {
+		t.Fatal("Got the wrong event:", event)
+	}
+
+	select {
+	case event := <-handled:
+		if event == nil || event.Name != config {
+			t.Fatal("Handler got the wrong event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the handler")
+	}
+	if len(handled) != 0 {
+		t.Fatal("Handler was called too often")
+	}
+	if n := atomic.LoadInt64(&notified); n > files+1 {
+		t.Fatal("NotifyEventContext was called", n, "times")
+	}
+}
+
+// Make sure a WaitEventContext that gives up does not hold up the subscribers,
+// and that WaitEvent is left with the most recent events.
+func TestWaitEventContextCancelledWithSubscribers(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan *Event, 10)
+	fw.NotifyEvent(func(event *Event, err error) {
+		notified <- event
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fw.WaitEventContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Wanted context.DeadlineExceeded got", err)
+	}
+
+	const files = 200
+	var events []Event
+	for i := 0; i < files; i++ {
+		events = append(events, Event{Name: filepath.Join(dir, fmt.Sprintf("test%d.txt", i)), Op: Create})
+	}
+	send(b, events...)
+	for _, want := range events {
+		select {
+		case event := <-notified:
+			if event.Name != want.Name {
+				t.Fatal("Wanted", want, "got", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out: the subscribers are held up")
+		}
+	}
+
+	want := events[files-DefaultSubscribeBuffer]
+	if event := waitEvent(t, fw); event.Name != want.Name {
+		t.Fatal("Wanted", want, "got", event)
+	}
+}
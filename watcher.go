@@ -1,10 +1,12 @@
 package bcnotify
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/facebookgo/stackerr"
 
@@ -16,33 +18,110 @@ var ErrWatcherClosed = fmt.Errorf("FileSystemWatcher closed")
 
 // watchPath represents a single path Added to the watcher
 type watchPath struct {
-	path    string // Path to watch
-	pattern string // Filename pattern to filter on (blank if no filter)
-	ops     Op     // Operation on which to filter (AllOps if no filter)
-	isdir   bool   // True if this is a directory
+	path       string        // Path to watch
+	root       string        // Path that was passed to AddFile or AddDir
+	include    []string      // Filename patterns to filter on (empty if no filter)
+	exclude    []string      // Filename patterns to drop even if included
+	ops        Op            // Operation on which to filter (AllOps if no filter)
+	isdir      bool          // True if this is a directory
+	recursive  bool          // True if directories created beneath this one are added
+	handler    int           // Handler to route events to (0 if none)
+	ignores    *ignoreSet    // Rules from ignore files (nil if none)
+	skipDirs   []string      // Patterns for directories not to watch beneath this one
+	skipFunc   SkipDirFunc   // Says whether not to watch a directory (nil if none)
+	filter     Filter        // Filter events must also match (nil if none)
+	file       os.FileInfo   // File that is watched, for paths added with AddFile
+	armed      time.Time     // When the watch last moved to a new file after an atomic save
+	persistent bool          // True if the file is watched through its directory
+	poll       time.Duration // How often to poll the path (0 to use the Backend)
 }
 
 // FileSystemWatcher represents a structure used to watch files on the file system.
 type FileSystemWatcher struct {
-	watcher    *fsnotify.Watcher // internal watcher that does all the real work
-	watchPaths []watchPath       // paths that are watched
+	watcher Backend // internal watcher that does all the real work, fsnotify by default
+
+	// mu guards watchPaths, which is read by WaitEvent while paths may be
+	// added or removed from other goroutines. It is held while changing the
+	// internal fsnotify watcher too, so that the two always agree.
+	mu          sync.RWMutex
+	watchPaths  *registry      // paths that are watched
+	handlers    map[int]func() // cancels the subscription for each handler
+	nextHandler int            // id of the last handler added
+
+	// heldHandlers collects the handlers to drop once a recursive add has
+	// succeeded, so that they are still there if it has to be undone.
+	heldHandlers *[]int
+
+	// anchors maps directories that are watched for the sake of files added
+	// with FileOptions.Persistent to those files.
+	anchors  map[string]map[string]struct{}
+	anchorOf map[string]string // the directory each of those files is watched through
+
+	hashes *contentHashes // contents of the files seen, if WithContentHash was given
+
+	poller   *poller       // watches the paths given their own PollInterval
+	fallback time.Duration // how often to poll paths once out of watches (0 to fail)
+
+	goneMu sync.Mutex
+	gone   map[string]time.Time // when persistent files went missing
+
+	pendingMu sync.Mutex
+	pending   []queued   // events and errors waiting to be returned by WaitEvent
+	lastMove  string     // old name of the last Move, guarded by pendingMu
+	saves     []heldSave // events held back by atomicSave, guarded by pendingMu
+
+	// subs are the subscribers that the dispatcher hands events to. The
+	// dispatcher only runs while there are any.
+	subsMu       sync.Mutex
+	subs         []*subscriber
+	stopDispatch context.CancelFunc
+	dispatchDone chan struct{}
+
+	// While a dispatcher is running, WaitEvent reads from waitSub so that it
+	// gets every event as well. dispatchStarted is closed when one starts.
+	dispatching     bool
+	dispatchGen     int // counts the dispatchers started
+	waitSub         *subscriber
+	dispatchStarted chan struct{}
 
 	closedMu sync.Mutex
 	isclosed bool
 	close    chan struct{}
 }
 
+// queued is an event or error generated by the watcher itself, such as the
+// Create events synthesized for files found in a newly added directory.
+type queued struct {
+	event     fsnotify.Event
+	err       error
+	synthetic bool       // True if the event did not come from fsnotify
+	watch     *watchPath // watchPath a Lost event, or one for a forgotten path, is for
+	ready     *Event     // Event that has already been through handle
+	held      bool       // True if atomicSave held the event back and let it go
+}
+
 // Event represents a single file system notification.
 type Event struct {
-	event fsnotify.Event
-	Name  string // Relative path to the file or directory.
-	Op    Op     // File operation that triggered the event.
+	watch   *watchPath  // watchPath the event was matched against
+	Name    string      // Relative path to the file or directory.
+	Op      Op          // File operation that triggered the event.
+	OldName string      // Path the file or directory had before a Move.
+	Time    time.Time   // Time the event was received.
+	IsDir   bool        // True if the event is for a directory.
+	Info    os.FileInfo // Info for the file or directory, or nil if it is gone.
+	Root    string      // Path passed to AddFile or AddDir that the event is for.
+	Rel     string      // Name relative to Root.
+
+	// Gap is how long a file added with FileOptions.Persistent was missing
+	// for, on the Create event when it comes back.
+	Gap time.Duration
 }
 
 func (e Event) String() string {
-	e.event.Name = e.Name
-	e.event.Op = fsnotify.Op(e.Op)
-	return e.event.String()
+	if len(e.OldName) > 0 {
+		return fmt.Sprintf("%q: %s from %q", e.Name, e.Op, e.OldName)
+	}
+	return fmt.Sprintf("%q: %s", e.Name, e.Op)
 }
 
 // Op describes a set of file operations.
@@ -56,32 +135,95 @@ const (
 	Rename
 	Chmod
 
+	// Lost is sent when a path passed to AddDir is removed or renamed, so
+	// nothing beneath it is watched any more. It comes after the Remove or
+	// Rename, and is always sent, whatever Op and pattern filters were given.
+	Lost
+
+	// Move is sent in place of a Rename and a Create when a file or directory
+	// is moved from one watched path to another, with the old path in
+	// Event.OldName. It is only sent if it is asked for, since AllOps does not
+	// include it. When it is asked for, a file moved out of the watched paths
+	// is reported as a Remove rather than a Rename.
+	//
+	// fsnotify does not say which Create goes with a Rename, so the Rename is
+	// paired with a Create that comes straight after it. A file moved out of
+	// the watched paths just before another is created, as in
+	// "mv a /elsewhere; touch b", is reported as b moved from a.
+	Move
+
 	AllOps = Create | Write | Remove | Rename | Chmod
 )
 
+func (op Op) String() string {
+	names := []struct {
+		op   Op
+		name string
+	}{
+		{Create, "CREATE"},
+		{Remove, "REMOVE"},
+		{Write, "WRITE"},
+		{Rename, "RENAME"},
+		{Chmod, "CHMOD"},
+		{Lost, "LOST"},
+		{Move, "MOVE"},
+	}
+	s := ""
+	for _, n := range names {
+		if op&n.op == n.op {
+			s += "|" + n.name
+		}
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return s[1:]
+}
+
 // wrapEvent takes an fsnotify.Event and returns a bcnotify.Event
 func wrapEvent(e fsnotify.Event) *Event {
-	return &Event{event: e, Name: e.Name, Op: Op(e.Op)}
+	return &Event{Name: e.Name, Op: Op(e.Op), Time: time.Now()}
+}
+
+// describe fills in the details of e that come from the file system and from
+// the watchPath it was matched against. It is only worth doing for events that
+// are going to be delivered.
+func (e *Event) describe() {
+	if info, err := os.Lstat(e.Name); err == nil {
+		e.Info = info
+		e.IsDir = info.IsDir()
+	}
+	if e.watch == nil {
+		return
+	}
+	// A directory that is gone can still be recognised if it was watched.
+	if e.Info == nil && e.watch.isdir && filepath.Clean(e.watch.path) == filepath.Clean(e.Name) {
+		e.IsDir = true
+	}
+	e.Root = e.watch.root
+	if rel, err := filepath.Rel(e.watch.root, e.Name); err == nil {
+		e.Rel = rel
+	}
 }
 
-// findWatchPath searches the FileSystemWatcher's watchPaths slice for one
-// that fits the given path and returns that watchPath.
+// findWatchPath searches the FileSystemWatcher's watchPaths for one that fits
+// the given path and returns that watchPath. The watchPath must not be changed.
 func (fw *FileSystemWatcher) findWatchPath(path string) *watchPath {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	return fw.lookup(path)
+}
+
+// lookup does the work for findWatchPath. fw.mu must be held.
+func (fw *FileSystemWatcher) lookup(path string) *watchPath {
 	// Check for full path first (if watching the specific file, this needs to go
 	// before the directory)
-	for _, p := range fw.watchPaths {
-		if filepath.Clean(path) == filepath.Clean(p.path) {
-			return &p
-		}
+	path = filepath.Clean(path)
+	if p := fw.watchPaths.get(path); p != nil {
+		return p
 	}
 	// Now check the directories
-	for _, p := range fw.watchPaths {
-		d := filepath.Dir(path)
-		if filepath.Clean(d) == filepath.Clean(p.path) {
-			return &p
-		}
-	}
-	return nil
+	return fw.watchPaths.get(filepath.Dir(path))
 }
 
 // filterByPattern takes a path and determines if it fits the filter given for
@@ -91,31 +233,67 @@ func (fw *FileSystemWatcher) filterByPattern(path string) bool {
 	if p == nil {
 		return false
 	}
+	return p.matchPattern(path)
+}
 
-	// If there was no filter pattern given, we allow it.
-	if len(p.pattern) == 0 {
-		return true
-	}
+// matchPattern determines if path fits the filter patterns of p.
+func (p *watchPath) matchPattern(path string) bool {
+	return p.matchEvent(&Event{Name: path, watch: p})
+}
 
+// matchEvent determines if e fits the filter patterns and Filter of p.
+func (p *watchPath) matchEvent(e *Event) bool {
 	// If this is a file that has been specifically added, we do not try any
 	// filters and just allow it.
 	if !p.isdir {
 		return true
 	}
 
-	// Run the filter on the filename only.
-	_, path = filepath.Split(path)
-	match, err := filepath.Match(p.pattern, path)
-	if err != nil {
-		fmt.Println(err)
+	if p.ignores != nil && p.ignores.ignored(e.Name, isDirNow(e.Name)) {
 		return false
 	}
-	if match {
+
+	// Exclude patterns win over include patterns.
+	for _, pattern := range p.exclude {
+		if globFilter(pattern).Match(e) {
+			return false
+		}
+	}
+
+	if !p.matchInclude(e) {
+		return false
+	}
+	return p.filter == nil || p.filter.Match(e)
+}
+
+// matchInclude determines if e fits any of the include patterns of p.
+func (p *watchPath) matchInclude(e *Event) bool {
+	// If there was no filter pattern given, we allow it.
+	if len(p.include) == 0 {
 		return true
 	}
+	for _, pattern := range p.include {
+		if globFilter(pattern).Match(e) {
+			return true
+		}
+	}
 	return false
 }
 
+// skipDir returns whether the directory at path should not be watched, even
+// though it is beneath a directory that was added with recursion.
+func (p *watchPath) skipDir(path string, info os.FileInfo) bool {
+	if p.ignores != nil && p.ignores.ignored(path, true) {
+		return true
+	}
+	for _, pattern := range p.skipDirs {
+		if globFilter(pattern).Match(&Event{Name: path, watch: p}) {
+			return true
+		}
+	}
+	return p.skipFunc != nil && p.skipFunc(path, info)
+}
+
 // filterByOp simply tests whether the given operation is included in the ones
 // set in the watchPath.
 func (fw *FileSystemWatcher) filterByOp(path string, op Op) bool {
@@ -123,6 +301,11 @@ func (fw *FileSystemWatcher) filterByOp(path string, op Op) bool {
 	if p == nil {
 		return false
 	}
+	return p.matchOp(op)
+}
+
+// matchOp tests whether op is included in the ones set for p.
+func (p *watchPath) matchOp(op Op) bool {
 	// This tests whether the given Op is included in the Op list
 	// (e.g. match Create against Create|Write)
 	if p.ops&op == op {
@@ -131,13 +314,34 @@ func (fw *FileSystemWatcher) filterByOp(path string, op Op) bool {
 	return false
 }
 
-// NewFileSystemWatcher returns an initialized *FileSystemWatcher.
-func NewFileSystemWatcher() (*FileSystemWatcher, error) {
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, stackerr.Wrap(err)
+// Option changes how a FileSystemWatcher works. Options are given to
+// NewFileSystemWatcher.
+type Option func(*FileSystemWatcher)
+
+// NewFileSystemWatcher returns an initialized *FileSystemWatcher, set up with
+// any options given.
+func NewFileSystemWatcher(opts ...Option) (*FileSystemWatcher, error) {
+	fw := &FileSystemWatcher{
+		watchPaths: newRegistry(),
+		handlers:   make(map[int]func()),
+		anchors:    make(map[string]map[string]struct{}),
+		anchorOf:   make(map[string]string),
+		gone:       make(map[string]time.Time),
+		poller:     newPoller(),
+		close:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(fw)
+	}
+	if fw.watcher == nil {
+		w, err := NewFSNotifyBackend()
+		if err != nil {
+			fw.poller.Close()
+			return nil, stackerr.Wrap(err)
+		}
+		fw.watcher = w
 	}
-	return &FileSystemWatcher{watcher: w, close: make(chan struct{})}, nil
+	return fw, nil
 }
 
 // Close closes the system resources for this FileSystemWatcher
@@ -149,46 +353,376 @@ func (fw *FileSystemWatcher) Close() error {
 	}
 	fw.isclosed = true
 	close(fw.close)
+	fw.poller.Close()
 	return fw.watcher.Close()
 }
 
 // WaitEvent blocks and waits until an event or error comes through.
 // This needs to be called in a go routine, probably in a loop.
+// Each event is only returned to one caller, so if there is more than one
+// consumer of events, use Subscribe or NotifyEvent for each instead.
+//
+// WaitEvent still gets every event while there are subscribers, including
+// those made by NotifyEvent and AddFileNotify. It then reads them from a
+// subscription of its own that uses the DropOldest policy, so the subscribers
+// are never held up by it, but if it falls more than DefaultSubscribeBuffer
+// events behind the oldest are dropped.
 func (fw *FileSystemWatcher) WaitEvent() (*Event, error) {
+	return fw.WaitEventContext(context.Background())
+}
+
+// WaitEventContext is like WaitEvent, but also stops waiting when ctx is done,
+// returning ctx.Err(). The FileSystemWatcher is left running.
+func (fw *FileSystemWatcher) WaitEventContext(ctx context.Context) (*Event, error) {
 	for {
 		select {
-		case event := <-fw.watcher.Events:
-			if fw.filterByOp(event.Name, Op(event.Op)) {
-				if fw.filterByPattern(event.Name) {
-					return wrapEvent(event), nil
-				}
+		case <-fw.close:
+			return nil, ErrWatcherClosed
+		default:
+		}
+		// While there are subscribers the dispatcher is reading events, so
+		// take them from it rather than competing with it.
+		sub, started := fw.waitSubscription()
+		if sub == nil {
+			event, err := fw.next(ctx, started)
+			if err == errDispatching {
+				continue
+			}
+			return event, err
+		}
+		if event, err, ok := sub.wait(ctx); ok {
+			return event, err
+		}
+	}
+}
+
+// errDispatching is returned by next when the dispatcher starts.
+var errDispatching = fmt.Errorf("dispatcher started")
+
+// next reads the next event or error from the Backend and the queue. It
+// returns errDispatching if started is closed first, and ctx.Err() if ctx is
+// done first.
+func (fw *FileSystemWatcher) next(ctx context.Context, started <-chan struct{}) (*Event, error) {
+	for {
+		// Anything still queued once the watcher is closed is of no use, and
+		// may well be an error caused by the close.
+		select {
+		case <-fw.close:
+			return nil, ErrWatcherClosed
+		case <-started:
+			return nil, errDispatching
+		default:
+		}
+		// Events generated by the watcher itself are returned before anything
+		// new from fsnotify so that they stay in order.
+		if q, ok := fw.popPending(); ok {
+			if q.err != nil {
+				return nil, q.err
+			}
+			if q.ready != nil {
+				return q.ready, nil
+			}
+			// Lost has no watchPath left to filter on.
+			if Op(q.event.Op)&Lost == Lost {
+				e := wrapEvent(q.event)
+				e.watch = q.watch
+				e.describe()
+				return e, nil
+			}
+			var e *Event
+			if q.held {
+				e = fw.handleSaved(q.event)
+			} else {
+				e = fw.handle(q.event, q.synthetic, q.watch)
 			}
+			if e != nil {
+				e.describe()
+				return e, nil
+			}
+			continue
+		}
+		// With nothing else queued, see whether any files held back by
+		// atomicSave have come back or been given up on, and look again every
+		// so often.
+		if settled := fw.settleSaves(""); len(settled) > 0 {
+			fw.pushPending(settled...)
 			continue
-		case err := <-fw.watcher.Errors:
+		}
+		var settle <-chan time.Time
+		if fw.holdingSaves() {
+			settle = time.After(5 * time.Millisecond)
+		}
+		select {
+		case event, ok := <-fw.watcher.Events():
+			// The Backend closes its channels when it is closed, which can be
+			// noticed before fw.close.
+			if !ok {
+				return nil, ErrWatcherClosed
+			}
+			if e := fw.handle(rawEvent(event), false, nil); e != nil {
+				e.describe()
+				return e, nil
+			}
+			continue
+		case err, ok := <-fw.watcher.Errors():
+			if !ok {
+				return nil, ErrWatcherClosed
+			}
 			return nil, stackerr.Wrap(err)
+		case event, ok := <-fw.poller.Events():
+			if !ok {
+				return nil, ErrWatcherClosed
+			}
+			if e := fw.handle(rawEvent(event), false, nil); e != nil {
+				e.describe()
+				return e, nil
+			}
+			continue
+		case err, ok := <-fw.poller.Errors():
+			if !ok {
+				return nil, ErrWatcherClosed
+			}
+			return nil, err
 		case <-fw.close:
 			return nil, ErrWatcherClosed
+		case <-started:
+			return nil, errDispatching
+		case <-settle:
+			continue
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// handle returns the event to deliver for the next event from fsnotify or the
+// queue, or nil if there is nothing to deliver. Atomic saves and moves are
+// recognised here before the event is processed on its own. If gone is not
+// nil, it is the watchPath the event was for before it was forgotten.
+func (fw *FileSystemWatcher) handle(event fsnotify.Event, synthetic bool, gone *watchPath) *Event {
+	if !synthetic {
+		if event.Op != fsnotify.Rename {
+			fw.forgetMove()
+		}
+		// An event held back by atomicSave for the same path has to be
+		// settled first to keep the two in order.
+		if settled := fw.settleSaves(event.Name); len(settled) > 0 {
+			fw.unshiftPending(append(settled, queued{event: event})...)
+			return nil
+		}
+		if e, ok := fw.atomicSave(event); ok {
+			return e
+		}
+		return fw.handleSaved(event)
+	}
+	return fw.process(event, synthetic, gone)
+}
+
+// handleSaved returns the event to deliver for a real event that is not part
+// of an atomic save, pairing it up if it is a move.
+func (fw *FileSystemWatcher) handleSaved(event fsnotify.Event) *Event {
+	if event.Op == fsnotify.Rename && fw.wantsMove(event.Name) {
+		return fw.pairMove(event)
+	}
+	return fw.process(event, false, nil)
+}
+
+// process handles the bookkeeping for a single event and returns it wrapped
+// if it makes it through the filters, or nil if it should be dropped.
+func (fw *FileSystemWatcher) process(event fsnotify.Event, synthetic bool, gone *watchPath) *Event {
+	// Synthesized events come from a walk that already added every directory
+	// it found, so only real events need to be checked for new directories.
+	if !synthetic {
+		// A directory that was added itself is forgotten once it is removed
+		// or renamed, but the event for it is still delivered before Lost.
+		if gone == nil && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			gone = fw.findWatchPath(event.Name)
 		}
+		fw.bookkeep(event)
+	}
+	return fw.filter(event, gone)
+}
+
+// bookkeep keeps the watched paths up to date with directories that are
+// created, removed or renamed.
+func (fw *FileSystemWatcher) bookkeep(event fsnotify.Event) {
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		fw.autoAdd(event.Name)
+		fw.descend(event.Name)
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		fw.prune(event.Name)
+		fw.ascend(event.Name)
+	}
+	if p := fw.findWatchPath(event.Name); p != nil && p.ignores != nil && p.ignores.isIgnoreFile(event.Name) {
+		fw.reloadIgnores(event.Name)
+	}
+}
+
+// filter returns the event wrapped if it makes it through the filters for its
+// path, or nil if it should be dropped. gone is used if nothing watched fits
+// the path any more.
+func (fw *FileSystemWatcher) filter(event fsnotify.Event, gone *watchPath) *Event {
+	// Look the path up once for all of the filters.
+	p := fw.findWatchPath(event.Name)
+	if p == nil {
+		p = gone
+	}
+	if p == nil {
+		return nil
+	}
+	if fw.hashes != nil && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		fw.hashes.forget(event.Name)
+	}
+	gap := fw.trackGap(p, event)
+	if p.matchOp(Op(event.Op)) {
+		e := wrapEvent(event)
+		e.watch = p
+		e.Gap = gap
+		if p.matchEvent(e) && !fw.unchanged(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// popPending removes and returns the oldest queued event or error.
+func (fw *FileSystemWatcher) popPending() (queued, bool) {
+	fw.pendingMu.Lock()
+	defer fw.pendingMu.Unlock()
+	if len(fw.pending) == 0 {
+		return queued{}, false
+	}
+	q := fw.pending[0]
+	fw.pending = fw.pending[1:]
+	return q, true
+}
+
+// pushPending queues events or errors to be returned by WaitEvent.
+func (fw *FileSystemWatcher) pushPending(q ...queued) {
+	fw.pendingMu.Lock()
+	fw.pending = append(fw.pending, q...)
+	fw.pendingMu.Unlock()
+}
+
+// unshiftPending queues events or errors to be returned by WaitEvent before
+// anything already queued.
+func (fw *FileSystemWatcher) unshiftPending(q ...queued) {
+	fw.pendingMu.Lock()
+	fw.pending = append(q, fw.pending...)
+	fw.pendingMu.Unlock()
+}
+
+// autoAdd registers a directory that was created beneath a recursively
+// watched directory. Anything created inside it before the watch was in place
+// would otherwise be missed, so it is added as well and Create events are
+// queued for it.
+func (fw *FileSystemWatcher) autoAdd(path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	parent := fw.lookup(path)
+	if parent == nil || !parent.isdir || !parent.recursive {
+		return
+	}
+	// Make sure we do not pick up a file that happens to share its name with
+	// a watched path.
+	if filepath.Clean(parent.path) == filepath.Clean(path) {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		// The directory may already be gone again, in which case there is
+		// nothing left to watch.
+		return
+	}
+	if parent.skipDir(path, info) {
+		return
+	}
+
+	var found []queued
+	err = fw.addTree(path, *parent, func(p string) {
+		found = append(found, queued{event: fsnotify.Event{Name: p, Op: fsnotify.Create}, synthetic: true})
+	})
+	if err != nil {
+		found = append(found, queued{err: err})
+	}
+	fw.pushPending(found...)
+}
+
+// prune forgets a watched directory, and everything watched beneath it, once
+// it has been removed or renamed. If it was added with AddDir, a Lost event is
+// queued for it.
+func (fw *FileSystemWatcher) prune(path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	p := fw.lookup(path)
+	if p == nil || !p.isdir || filepath.Clean(p.path) != filepath.Clean(path) {
+		return
+	}
+	lost := filepath.Clean(p.root) == filepath.Clean(p.path)
+
+	for _, sub := range fw.watchPaths.subtree(path) {
+		// Persistent files are kept for when they come back.
+		if sub.persistent {
+			continue
+		}
+		// fsnotify has already dropped the watch if the directory was removed,
+		// but not if it was renamed, so errors here are expected.
+		fw.unwatch(sub.path)
+		fw.watchPaths.remove(sub.path)
+		if sub.ignores != nil {
+			sub.ignores.drop(sub.path)
+		}
+	}
+
+	if lost {
+		fw.pushPending(queued{event: fsnotify.Event{Name: path, Op: fsnotify.Op(Lost)}, synthetic: true, watch: p})
 	}
 }
 
 // NotifyEvent accepts a function that takes a *bcnotify.Event and error
 // and calls that function whenever an event or error happens.
+// It can be called more than once, and every function is called for every
+// event.
 func (fw *FileSystemWatcher) NotifyEvent(notify func(*Event, error)) {
+	fw.NotifyEventContext(context.Background(), notify)
+}
+
+// NotifyEventContext is like NotifyEvent, but stops calling notify once ctx is
+// done or the returned stop function is called, leaving the FileSystemWatcher
+// running for anything else that uses it. A call to notify that is already
+// under way when it stops is allowed to finish.
+func (fw *FileSystemWatcher) NotifyEventContext(ctx context.Context, notify func(*Event, error)) (stop func()) {
+	events, errs, cancel := fw.Subscribe(nil)
 	go func() {
+		defer cancel()
 		for {
-			event, err := fw.WaitEvent()
-			if err != nil {
-				// ErrWatcherClosed is returned when the FileSystemWatcher is closed, so // we just want to return out of this loop and function in that case.
-				if err == ErrWatcherClosed {
+			select {
+			case event, ok := <-events:
+				// The channels are closed when the FileSystemWatcher is closed,
+				// so we just want to return out of this loop and function then.
+				if !ok {
+					return
+				}
+				// Check the context again, since it may have been cancelled
+				// while the event was on its way.
+				if ctx.Err() != nil {
+					return
+				}
+				notify(&event, nil)
+			case err, ok := <-errs:
+				if !ok {
 					return
 				}
 				notify(nil, err)
-				continue
+			case <-ctx.Done():
+				return
 			}
-			notify(event, nil)
 		}
 	}()
+	return cancel
 }
 
 // isDir returns whether a given path is a directory and an error if one occurs.
@@ -200,132 +734,272 @@ func isDir(path string) (bool, error) {
 	return fi.IsDir(), nil
 }
 
+// isDirNow returns whether path is a directory, without following symlinks.
+// Anything that cannot be found, such as a path that was just removed, is
+// taken to be a file.
+func isDirNow(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.IsDir()
+}
+
+// isWatchedDir is like isDir, but falls back on what was recorded when the path
+// was added if it no longer exists. fw.mu must be held.
+func (fw *FileSystemWatcher) isWatchedDir(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err == nil {
+		return fi.IsDir(), nil
+	}
+	if !os.IsNotExist(err) {
+		return false, stackerr.Wrap(err)
+	}
+	if p := fw.watchPaths.get(filepath.Clean(path)); p != nil {
+		return p.isdir, nil
+	}
+	return false, stackerr.Wrap(err)
+}
+
 // AddFile adds a file to be watched along with an Op on which to filter events, // returning an error if any.
 func (fw *FileSystemWatcher) AddFile(path string, ops Op) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return fw.addFile(path, watchPath{root: path, ops: ops})
+}
+
+// addFile adds a file to watch with the configuration in conf.
+// fw.mu must be held.
+func (fw *FileSystemWatcher) addFile(path string, conf watchPath) error {
 	// Check if this is a directory and return an error if it is.
-	if isdir, err := isDir(path); err == nil && isdir {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
 		return fmt.Errorf("Use AddDir instead for %s", path)
 	} else if err != nil {
 		return stackerr.Wrap(err)
 	}
 	// Add the path to the internal fsnotify watcher.
-	err := fw.watcher.Add(path)
+	err = fw.addWatch(path, conf.poll)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 	// Add the path to watchPaths so we can search for it later and see
 	// its configuration.
-	fw.watchPaths = append(fw.watchPaths, watchPath{path: path, ops: ops})
+	conf.path = path
+	conf.file = info
+	fw.replace(conf)
+	// Start from what the file holds now, so that the first Write can be
+	// compared with it.
+	if fw.hashes != nil {
+		fw.hashes.update(path)
+	}
 	return nil
 }
 
 // RemoveFile removes a file from being watched and returns and error if any.
+// The file does not need to exist any more.
 func (fw *FileSystemWatcher) RemoveFile(path string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
 	// Check if this is a directory and return an error if it is.
-	if isdir, err := isDir(path); err == nil && isdir {
+	if isdir, err := fw.isWatchedDir(path); err == nil && isdir {
 		return fmt.Errorf("Use RemoveDir instead for %s", path)
 	} else if err != nil {
 		return stackerr.Wrap(err)
 	}
-	// Remove the path from the internal fsnotify watcher.
-	err := fw.watcher.Remove(path)
-	if err != nil {
-		return stackerr.Wrap(err)
+	// Remove the path from the internal fsnotify watcher. Persistent files
+	// are watched through their directory, which forget looks after.
+	if p := fw.watchPaths.get(filepath.Clean(path)); p == nil || !p.persistent {
+		err := fw.removeWatch(path)
+		if err != nil && exists(path) {
+			return stackerr.Wrap(err)
+		}
 	}
-	fw.watchPaths = removePath(fw.watchPaths, path)
+	fw.forget(path)
 	return nil
 }
 
-func removePath(paths []watchPath, path string) []watchPath {
-	// Remove the path from watchPaths
-	index := 0
-	found := false
-	for index = 0; index < len(paths); index++ {
-		if paths[index].path == path {
-			found = true
-			break
-		}
-	}
-	if found {
-		paths = append(paths[0:index], paths[index+1:]...)
-	}
-	return paths
+// exists returns whether anything can be found at path. fsnotify drops its
+// watch on a path once it is deleted, so errors removing a watch on a path that
+// no longer exists are not worth reporting.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
 }
 
-// addDir adds a directory path to watch with a filename pattern on which to
-// filter and an Op on which to filter events.
-func (fw *FileSystemWatcher) addDir(path, pattern string, ops Op) error {
+// addDir adds a directory path to watch, using the filename pattern, Op and
+// other configuration in conf to filter events. fw.mu must be held.
+func (fw *FileSystemWatcher) addDir(path string, conf watchPath) error {
 	// First ensure that the given path really is a directory.
 	if isdir, err := isDir(path); err == nil && !isdir {
 		return fmt.Errorf("Use AddFile instead for %s", path)
 	} else if err != nil {
 		return stackerr.Wrap(err)
 	}
+	// Read the ignore files first, so that they apply to anything found in
+	// the directory from now on.
+	if conf.ignores != nil {
+		if err := conf.ignores.load(path); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
 	// Add path to internal fsnotify watcher.
-	err := fw.watcher.Add(path)
+	err := fw.addWatch(path, conf.poll)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 
 	// Add to watchPaths so we can find it later with its configuration.
-	fw.watchPaths = append(fw.watchPaths, watchPath{path: path, pattern: pattern, ops: ops, isdir: true})
+	conf.path = path
+	conf.isdir = true
+	fw.replace(conf)
 
 	return nil
 }
 
+// replace adds conf to watchPaths. If it replaces a path that was added with
+// a handler of its own, that handler is dropped. fw.mu must be held.
+func (fw *FileSystemWatcher) replace(conf watchPath) {
+	old := fw.watchPaths.get(filepath.Clean(conf.path))
+	fw.dropHandler(old, conf.handler)
+	// A persistent file added again keeps its directory watched.
+	if old != nil && old.persistent && !conf.persistent {
+		fw.unanchor(old.path)
+	}
+	fw.watchPaths.add(conf)
+}
+
+// forget removes path from watchPaths, along with its handler if it was the
+// path the handler was added for. fw.mu must be held.
+func (fw *FileSystemWatcher) forget(path string) {
+	old := fw.watchPaths.get(filepath.Clean(path))
+	fw.dropHandler(old, 0)
+	fw.watchPaths.remove(path)
+	if old != nil && old.persistent {
+		fw.unanchor(old.path)
+		fw.forgetGap(old.path)
+	}
+}
+
 // AddDir adds a directory to be watched, returning an error if any.
 // It allows a filter to be specified on which files to watch.
-// It also allows recursive watching.
+// It also allows recursive watching, in which case directories created later
+// beneath path are added automatically with the same filter.
+// If the directory is later removed or renamed, it stops being watched and a
+// Lost event is sent. Adding a path again replaces its filter.
+// A malformed pattern is returned as an error.
 func (fw *FileSystemWatcher) AddDir(path, pattern string, ops Op, recursive bool) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
 
+	return fw.addDirs(path, watchPath{root: path, include: patterns(pattern), ops: ops, recursive: recursive})
+}
+
+// patterns turns the single pattern given to AddDir into a list of them.
+func patterns(pattern string) []string {
+	if len(pattern) == 0 {
+		return nil
+	}
+	return []string{pattern}
+}
+
+// addDirs adds a directory with the configuration in conf, along with the
+// directories beneath it if conf.recursive is set. fw.mu must be held.
+func (fw *FileSystemWatcher) addDirs(path string, conf watchPath) error {
 	// Add the given path to be watched. addDir will perform checking for us to
 	// ensure that the path really is a directory.
-	err := fw.addDir(path, pattern, ops)
+	if !conf.recursive {
+		return fw.addDir(path, conf)
+	}
+	// Put things back as they were if the tree cannot be added in full, so
+	// that it is not left half watched.
+	before := make(map[string]*watchPath)
+	for _, p := range fw.watchPaths.subtree(path) {
+		before[filepath.Clean(p.path)] = p
+	}
+	var held []int
+	fw.heldHandlers = &held
+	err := fw.addTree(path, conf, nil)
+	fw.heldHandlers = nil
 	if err != nil {
-		return stackerr.Wrap(err)
+		fw.rollback(path, before)
+		return err
 	}
+	for _, id := range held {
+		fw.removeHandler(id)
+	}
+	return nil
+}
 
-	if recursive {
-		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				// Subdirectories inherit the filename pattern and ops from the parent.
-				if e := fw.addDir(p, pattern, ops); err != nil {
-					return stackerr.Wrap(e)
-				}
+// addTree recursively adds the directory at root and every directory beneath
+// it. If found is not nil, it is called with every path below root that the
+// walk comes across. fw.mu must be held.
+func (fw *FileSystemWatcher) addTree(root string, conf watchPath, found func(path string)) error {
+	// Make sure root is a directory before walking it, since filepath.Walk
+	// is happy to walk a single file.
+	if err := fw.addDir(root, conf); err != nil {
+		return stackerr.Wrap(err)
+	}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Entries can disappear while we walk; there is nothing to add then.
+			if os.IsNotExist(err) {
+				return nil
 			}
+			return stackerr.Wrap(err)
+		}
+		if p == root {
 			return nil
-		})
-		if err != nil {
-			return err
 		}
-	}
-
-	return nil
+		if info.IsDir() {
+			if conf.skipDir(p, info) {
+				return filepath.SkipDir
+			}
+			// Subdirectories inherit the configuration from the parent.
+			if e := fw.addDir(p, conf); e != nil {
+				// Skip directories that were removed before we got to them.
+				if !exists(p) {
+					return filepath.SkipDir
+				}
+				return stackerr.Wrap(e)
+			}
+		}
+		if found != nil {
+			found(p)
+		}
+		return nil
+	})
 }
 
-// RemoveDir removes a directory from the watcher and returns error if any
+// removeDir removes a directory from the watcher and returns error if any.
+// fw.mu must be held.
 func (fw *FileSystemWatcher) removeDir(path string) error {
 	// First ensure that the given path really is a directory.
-	if isdir, err := isDir(path); err == nil && !isdir {
+	if isdir, err := fw.isWatchedDir(path); err == nil && !isdir {
 		return fmt.Errorf("Use RemoveFile instead for %s", path)
 	} else if err != nil {
 		return stackerr.Wrap(err)
 	}
 	// Remove path from internal fsnotify watcher.
-	err := fw.watcher.Remove(path)
-	if err != nil {
+	err := fw.unwatch(path)
+	if err != nil && exists(path) {
 		return stackerr.Wrap(err)
 	}
 
-	// Add to watchPaths so we can find it later with its configuration.
-	fw.watchPaths = removePath(fw.watchPaths, path)
+	// Remove from watchPaths so it is no longer found.
+	fw.forget(path)
 
 	return nil
 }
 
 // RemoveDir removes a directory from being watched, returning an error if any.
-// It also allows recursive removal.
+// It also allows recursive removal of every watched directory beneath it.
+// The directory does not need to exist any more.
 func (fw *FileSystemWatcher) RemoveDir(path string, recursive bool) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
 
 	// Remove the given path from being watched.
 	err := fw.removeDir(path)
@@ -334,16 +1008,15 @@ func (fw *FileSystemWatcher) RemoveDir(path string, recursive bool) error {
 	}
 
 	if recursive {
-		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				if e := fw.removeDir(p); err != nil {
-					return stackerr.Wrap(e)
-				}
+		// Use what was registered rather than walking the directory, which may
+		// be gone or may have changed since it was added.
+		for _, p := range fw.watchPaths.subtree(path) {
+			if !p.isdir {
+				continue
+			}
+			if e := fw.removeDir(p.path); e != nil {
+				return stackerr.Wrap(e)
 			}
-			return nil
-		})
-		if err != nil {
-			return err
 		}
 	}
 
@@ -1,10 +1,13 @@
 package bcnotify
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -20,6 +23,39 @@ func makeTestDir(t *testing.T) string {
 	return dir
 }
 
+// newFakeWatcher returns a FileSystemWatcher that only sees the events sent
+// through the FakeBackend returned with it.
+func newFakeWatcher(t *testing.T) (*FileSystemWatcher, *FakeBackend) {
+	b := NewFakeBackend()
+	fw, err := NewFileSystemWatcher(WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fw, b
+}
+
+// send sends events through b in order from another goroutine, since each
+// Send waits for the watcher to take the event.
+func send(b *FakeBackend, events ...Event) {
+	go func() {
+		for _, e := range events {
+			b.Send(e.Name, e.Op)
+		}
+	}()
+}
+
+// waitEvent returns the next event from fw, failing the test if there is an
+// error instead or nothing arrives.
+func waitEvent(t *testing.T, fw *FileSystemWatcher) *Event {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := fw.WaitEventContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
 func TestMain(m *testing.M) {
 	code := m.Run()
 	// Give time to clean up any leftover test* directories
@@ -36,6 +72,12 @@ func TestEventString(t *testing.T) {
 	if event.String() != expected {
 		t.Fatalf("Wanted %q got %q", expected, event.String())
 	}
+
+	event.Op = Remove | Lost
+	expected = `"testfile.txt": REMOVE|LOST`
+	if event.String() != expected {
+		t.Fatalf("Wanted %q got %q", expected, event.String())
+	}
 }
 
 // Make sure private method findWatchPath works as advertized
@@ -44,7 +86,7 @@ func TestFindWatchPath(t *testing.T) {
 	defer fw.Close()
 	wp := []string{"test.txt", "testdir", "testdir/test.txt"}
 	for _, test := range wp {
-		fw.watchPaths = append(fw.watchPaths, watchPath{path: test})
+		fw.watchPaths.add(watchPath{path: test})
 	}
 	p := fw.findWatchPath("none")
 	if p != nil {
@@ -65,7 +107,7 @@ func TestFilterByPattern(t *testing.T) {
 	defer fw.Close()
 	wp := []string{"test.txt", "testdir", "testdir/test.txt"}
 	for _, test := range wp {
-		fw.watchPaths = append(fw.watchPaths, watchPath{path: test, pattern: "*test*"})
+		fw.watchPaths.add(watchPath{path: test, include: []string{"*test*"}})
 	}
 	if fw.filterByPattern("none") {
 		t.Fatal("filterByPattern returned true when it should have returned false")
@@ -84,7 +126,7 @@ func TestFilterByOp(t *testing.T) {
 	defer fw.Close()
 	wp := []string{"test.txt", "testdir", "testdir/test.txt"}
 	for _, test := range wp {
-		fw.watchPaths = append(fw.watchPaths, watchPath{path: test, ops: Write})
+		fw.watchPaths.add(watchPath{path: test, ops: Write})
 	}
 	if fw.filterByOp("none", Write) {
 		t.Fatal("filterByOp returned true when it should have returned false")
@@ -142,7 +184,7 @@ func TestFileSystemWatcherAddFile(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	filename := filepath.Join(dir, "test.txt")
@@ -156,6 +198,9 @@ func TestFileSystemWatcherAddFile(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if !b.Watching(filename) {
+		t.Fatal("AddFile did not watch", filename)
+	}
 
 	done := make(chan struct{})
 	fw.NotifyEvent(func(event *Event, err error) {
@@ -178,12 +223,13 @@ func TestFileSystemWatcherAddFile(t *testing.T) {
 
 	// Write the file again
 	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Write})
 
 	// Wait until the event is caught and tested or we time out.
 	select {
 	case <-done:
 		return
-	case <-time.Tick(100 * time.Millisecond):
+	case <-time.After(time.Second):
 		t.Fatal("Timed out")
 	}
 
@@ -195,7 +241,7 @@ func TestFileSystemWatcherAddFileOpFilter(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	filename := filepath.Join(dir, "test.txt")
@@ -210,37 +256,17 @@ func TestFileSystemWatcherAddFileOpFilter(t *testing.T) {
 		t.Error(err)
 	}
 
-	done := make(chan struct{})
-	fw.NotifyEvent(func(event *Event, err error) {
-		// Make sure we send the done channel a signal at the end.
-		defer func() {
-			done <- struct{}{}
-		}()
+	// The Write comes first, so it must have been filtered out if the Chmod
+	// is the first event delivered.
+	send(b, Event{Name: filename, Op: Write}, Event{Name: filename, Op: Chmod})
 
-		if err != nil {
-			t.Error(err)
-		}
-		if event == nil {
-			t.Fatal("event should not be nil")
-		}
-		if event.Name != filename {
-			t.Fatalf("event does not have correct filename. Wanted %s got %s", filename, event.Name)
-		}
-		if event.Op&Chmod != Chmod {
-			t.Fatal("Got wrong event:", event.Op)
-		}
-	})
-
-	doFileOps(t, filename)
-
-	// Wait until the event is caught and tested or we time out.
-	select {
-	case <-done:
-		return
-	case <-time.Tick(100 * time.Millisecond):
-		t.Fatal("Timed out")
+	event := waitEvent(t, fw)
+	if event.Name != filename {
+		t.Fatalf("event does not have correct filename. Wanted %s got %s", filename, event.Name)
+	}
+	if event.Op != Chmod {
+		t.Fatal("Got wrong event:", event.Op)
 	}
-
 }
 
 // Make sure that removing a file with RemoveFile works correctly
@@ -249,7 +275,7 @@ func TestFileSystemWatcherRemoveFile(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	filename := filepath.Join(dir, "test.txt")
@@ -269,19 +295,15 @@ func TestFileSystemWatcherRemoveFile(t *testing.T) {
 		t.Error(err)
 	}
 
-	fw.NotifyEvent(func(event *Event, err error) {
-		t.Fatal("Should not have notified of event.")
-	})
-
-	// Write the file again
-	ioutil.WriteFile(filename, []byte("test"), 0700)
-
-	// Wait until the event is caught and tested or we time out.
-	select {
-	case <-time.Tick(100 * time.Millisecond):
-		t.Log("timed out, which we wanted")
+	if b.Watching(filename) {
+		t.Fatal("Still watching", filename)
+	}
+	if fw.findWatchPath(filename) != nil {
+		t.Fatal("RemoveFile left", filename, "behind")
+	}
+	if b.Send(filename, Write) {
+		t.Fatal("Should not have been sent an event.")
 	}
-
 }
 
 // Make sure adding directories recursively works
@@ -290,7 +312,7 @@ func TestFileSystemWatcherAddDirRecursive(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Create a subdirectory for testing recursive adds
@@ -300,20 +322,17 @@ func TestFileSystemWatcherAddDirRecursive(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if !b.Watching(filepath.Join(dir, "sub")) {
+		t.Fatal("AddDir did not watch the subdirectory")
+	}
 
 	// Setup the NotifyEvent function
 	filename := filepath.Join(dir, "sub", "testfile.txt")
 	done := make(chan struct{})
-	isdone := false
+	var once sync.Once
 	fw.NotifyEvent(func(event *Event, err error) {
-		if isdone {
-			return
-		}
 		// Make sure we send the done channel a signal at the end.
-		defer func() {
-			isdone = true
-			done <- struct{}{}
-		}()
+		defer once.Do(func() { close(done) })
 
 		if err != nil {
 			t.Error(err)
@@ -328,23 +347,66 @@ func TestFileSystemWatcherAddDirRecursive(t *testing.T) {
 
 	// Actually write the file
 	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Create})
 
 	// Wait until the event is caught and tested or we time out.
 	select {
 	case <-done:
 		return
-	case <-time.Tick(100 * time.Millisecond):
+	case <-time.After(time.Second):
 		t.Fatal("Timed out")
 	}
 }
 
+// Make sure directories created after a recursive AddDir are watched too,
+// including files that were created before the new watch was in place.
+func TestFileSystemWatcherAddDirRecursiveLive(t *testing.T) {
+	// Setup the test directory
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "*.txt", Create|Write, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Create the directories and a file before the watcher hears about the
+	// first directory, as happens when it is slower than whoever makes them.
+	early := filepath.Join(dir, "a", "b", "early.txt")
+	late := filepath.Join(dir, "a", "b", "late.txt")
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0700)
+	ioutil.WriteFile(early, []byte("test"), 0700)
+	send(b, Event{Name: filepath.Join(dir, "a"), Op: Create})
+
+	if event := waitEvent(t, fw); event.Name != early || event.Op != Create {
+		t.Fatal("Wanted Create for", early, "got", event)
+	}
+	if !b.Watching(filepath.Join(dir, "a", "b")) {
+		t.Fatal("new directory is not watched")
+	}
+
+	ioutil.WriteFile(late, []byte("test"), 0700)
+	send(b, Event{Name: late, Op: Create})
+	if event := waitEvent(t, fw); event.Name != late || event.Op != Create {
+		t.Fatal("Wanted Create for", late, "got", event)
+	}
+
+	p := fw.findWatchPath(filepath.Join(dir, "a", "b", "x"))
+	if p == nil || !p.recursive || len(p.include) != 1 || p.include[0] != "*.txt" {
+		t.Fatal("new directory was not added with the parent's configuration")
+	}
+}
+
 // Make sure removing directories with recursion works
 func TestFileSystemWatcherRemoveDirRecursive(t *testing.T) {
 	// Setup the test directory
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	err := os.MkdirAll(filepath.Join(dir, "sub"), 0700)
@@ -362,24 +424,226 @@ func TestFileSystemWatcherRemoveDirRecursive(t *testing.T) {
 		t.Error(err)
 	}
 
-	// Setup the NotifyEvent function
+	if watched := b.Watched(); len(watched) != 0 {
+		t.Fatal("Still watching", watched)
+	}
+	for _, filename := range []string{
+		filepath.Join(dir, "sub", "testfile.txt"),
+		filepath.Join(dir, "testfile.txt"),
+	} {
+		if b.Send(filename, Create) {
+			t.Fatal("event still sent for", filename)
+		}
+		if fw.findWatchPath(filename) != nil {
+			t.Fatal("RemoveDir left a path behind for", filename)
+		}
+	}
+}
+
+// Make sure watched directories are forgotten when they are removed or
+// renamed, and that a Lost event is only sent for the directory that was added.
+func TestFileSystemWatcherPruneRemovedDirs(t *testing.T) {
+	tests := []struct {
+		remove func(string) error
+		events func(dir string) []Event
+	}{
+		{
+			remove: os.RemoveAll,
+			// fsnotify reports each directory going, deepest first.
+			events: func(dir string) []Event {
+				return []Event{
+					{Name: filepath.Join(dir, "sub", "deeper"), Op: Remove},
+					{Name: filepath.Join(dir, "sub"), Op: Remove},
+					{Name: dir, Op: Remove},
+				}
+			},
+		},
+		{
+			remove: func(p string) error { return os.Rename(p, p+".moved") },
+			events: func(dir string) []Event {
+				return []Event{{Name: dir, Op: Rename}}
+			},
+		},
+	}
+	for _, test := range tests {
+		// Setup the test directories
+		parent := makeTestDir(t)
+		defer os.RemoveAll(parent)
+		dir := filepath.Join(parent, "root")
+		os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0700)
+
+		fw, b := newFakeWatcher(t)
+		defer fw.Close()
+
+		// Only ask for Create so any other event we see must be Lost.
+		err := fw.AddDir(dir, "", Create, true)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = test.remove(dir)
+		if err != nil {
+			t.Error(err)
+		}
+		send(b, test.events(dir)...)
+
+		if event := waitEvent(t, fw); event.Op != Lost || event.Name != dir {
+			t.Fatal("Wanted Lost event for", dir, "got", event)
+		}
+
+		if p := fw.findWatchPath(filepath.Join(dir, "sub", "deeper")); p != nil {
+			t.Fatal("Removed directory is still watched:", p.path)
+		}
+		if watched := b.Watched(); len(watched) != 0 {
+			t.Fatal("Backend is still watching", watched)
+		}
+	}
+}
+
+// Make sure the Remove or Rename of a directory that was added is still
+// delivered when it is asked for, followed by Lost.
+func TestFileSystemWatcherRemovedDirEvent(t *testing.T) {
+	for _, op := range []Op{Remove, Rename} {
+		dir := makeTestDir(t)
+		defer os.RemoveAll(dir)
+
+		fw, b := newFakeWatcher(t)
+		defer fw.Close()
+
+		err := fw.AddDir(dir, "", AllOps, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		send(b, Event{Name: dir, Op: op})
+		for _, want := range []Op{op, Lost} {
+			if event := waitEvent(t, fw); event.Op != want || event.Name != dir {
+				t.Fatal("Wanted", want, "for", dir, "got", event)
+			}
+		}
+	}
+}
+
+// Make sure directories can be removed from the watcher after they are gone.
+func TestFileSystemWatcherRemoveDirMissing(t *testing.T) {
+	// Setup the test directory
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := newFakeWatcher(t)
+	defer fw.Close()
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+	err := fw.AddDir(dir, "", AllOps, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// No events have been sent, so the watcher has not pruned anything yet.
+	os.RemoveAll(dir)
+
+	err = fw.RemoveDir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.watchPaths.len() != 0 {
+		t.Fatal("RemoveDir left paths behind:", fw.watchPaths.paths)
+	}
+}
+
+// Make sure paths can be added and removed from other goroutines while events
+// are flowing. This is mostly useful with the race detector turned on.
+func TestFileSystemWatcherConcurrentAddRemove(t *testing.T) {
+	// Setup the test directory
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, _ := NewFileSystemWatcher()
+	defer fw.Close()
+
+	// churn has directories created and removed beneath it the whole time,
+	// so the watcher keeps adding and pruning on its own.
+	churn := filepath.Join(dir, "churn")
+	os.MkdirAll(churn, 0700)
+	err := fw.AddDir(churn, "", AllOps, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
 	fw.NotifyEvent(func(event *Event, err error) {
-		t.Fatal("event still fired")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		atomic.AddInt64(&count, 1)
 	})
 
-	filename := filepath.Join(dir, "sub", "testfile.txt")
-	// Actually write the file
-	ioutil.WriteFile(filename, []byte("test"), 0700)
-
-	filename = filepath.Join(dir, "testfile.txt")
-	ioutil.WriteFile(filename, []byte("test"), 0700)
+	stop := make(chan struct{})
+	var wait sync.WaitGroup
 
-	// Wait until the event is caught and tested or we time out.
-	select {
-	case <-time.Tick(100 * time.Millisecond):
-		if !t.Failed() {
-			t.Log("Timed out, which is what we wanted")
+	// Generate a storm of events.
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sub := filepath.Join(churn, fmt.Sprint(i%5), "nested")
+			os.MkdirAll(sub, 0700)
+			ioutil.WriteFile(filepath.Join(sub, "test.txt"), []byte("test"), 0700)
+			ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("a%d", i%4), "test.txt"), []byte("test"), 0700)
+			if i%3 == 0 {
+				os.RemoveAll(filepath.Join(churn, fmt.Sprint(i%5)))
+			}
 		}
+	}()
+
+	// Keep adding and removing other directories and files at the same time.
+	for i := 0; i < 4; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("a%d", i))
+		os.MkdirAll(filepath.Join(sub, "nested"), 0700)
+		filename := filepath.Join(sub, "file.txt")
+		ioutil.WriteFile(filename, []byte("test"), 0700)
+
+		wait.Add(1)
+		go func(recursive bool) {
+			defer wait.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := fw.AddDir(sub, "*.txt", AllOps, recursive); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := fw.AddFile(filename, Write); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := fw.RemoveFile(filename); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := fw.RemoveDir(sub, recursive); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wait.Wait()
+
+	if atomic.LoadInt64(&count) == 0 {
+		t.Fatal("No events were delivered")
 	}
 }
 
@@ -389,7 +653,7 @@ func TestFileSystemWatcherAddDirNotRecursive(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Create a subdirectory for testing recursive adds
@@ -400,27 +664,25 @@ func TestFileSystemWatcherAddDirNotRecursive(t *testing.T) {
 		t.Error(err)
 	}
 
-	// Setup the NotifyEvent function
-	filename := filepath.Join(dir, "sub", "testfile.txt")
-	done := make(chan struct{})
-	isdone := false
-	fw.NotifyEvent(func(event *Event, err error) {
-		if isdone {
-			return
-		}
-		isdone = true
-		done <- struct{}{}
-	})
-
 	// Actually write the file
+	filename := filepath.Join(dir, "sub", "testfile.txt")
 	ioutil.WriteFile(filename, []byte("test"), 0700)
 
-	// Wait until the event is caught and tested or we time out.
-	select {
-	case <-done:
-		t.Fatal("Should not have received notification for subdirectory")
-	case <-time.Tick(100 * time.Millisecond):
-		return
+	if b.Watching(filepath.Join(dir, "sub")) {
+		t.Fatal("Should not be watching the subdirectory")
+	}
+	if b.Send(filename, Create) {
+		t.Fatal("Should not have been sent an event for the subdirectory")
+	}
+
+	// A new directory is not added either.
+	os.Mkdir(filepath.Join(dir, "new"), 0700)
+	send(b, Event{Name: filepath.Join(dir, "new"), Op: Create})
+	if event := waitEvent(t, fw); event.Name != filepath.Join(dir, "new") {
+		t.Fatal("Got the wrong event:", event)
+	}
+	if b.Watching(filepath.Join(dir, "new")) {
+		t.Fatal("Should not be watching the new directory")
 	}
 }
 
@@ -430,7 +692,7 @@ func TestFileSystemWatcherRemoveDirNotRecursive(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Create a subdirectory for testing non-recursive removes
@@ -446,28 +708,18 @@ func TestFileSystemWatcherRemoveDirNotRecursive(t *testing.T) {
 		t.Error(err)
 	}
 
-	done := make(chan struct{})
-	// Setup the NotifyEvent function
-	fw.NotifyEvent(func(event *Event, err error) {
-		filename := filepath.Join(dir, "testfile.txt")
-		if event.Name == filename {
-			t.Fatal("event still fired")
-		}
-		done <- struct{}{}
-	})
-
 	filename := filepath.Join(dir, "testfile.txt")
 	ioutil.WriteFile(filename, []byte("test"), 0700)
+	if b.Send(filename, Create) {
+		t.Fatal("event still sent for", filename)
+	}
 
 	filename = filepath.Join(dir, "sub", "testfile.txt")
 	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Create})
 
-	// Wait until the event is caught and tested or we time out.
-	select {
-	case <-done:
-		return
-	case <-time.Tick(100 * time.Millisecond):
-		t.Fatal("Timed out")
+	if event := waitEvent(t, fw); event.Name != filename {
+		t.Fatalf("event does not have correct filename. Wanted %s got %s", filename, event.Name)
 	}
 }
 
@@ -477,7 +729,7 @@ func TestFileSystemWatcherWaitEvent(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Add directory without any filtering, without recursion
@@ -500,30 +752,50 @@ func TestFileSystemWatcherWaitEvent(t *testing.T) {
 		}
 
 		if event == nil {
-			t.Fatal("WaitEvent returned without error but with nil event")
+			t.Error("WaitEvent returned without error but with nil event")
 		}
 
 	}()
 
 	// Actually write the file
-	ioutil.WriteFile(filepath.Join(dir, "testfile"), []byte("test"), 0700)
+	filename := filepath.Join(dir, "testfile")
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Create})
 
 	// Wait until the event is received or we timeout
 	select {
 	case <-done:
 		return
-	case <-time.Tick(100 * time.Millisecond):
+	case <-time.After(time.Second):
 		t.Fatal("Timed out")
 	}
 }
 
+// Make sure WaitEvent returns errors from the Backend
+func TestFileSystemWatcherWaitEventError(t *testing.T) {
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	go b.SendError(errors.New("test error"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := fw.WaitEventContext(ctx)
+	if err == nil || !strings.Contains(err.Error(), "test error") {
+		t.Fatal("Wanted the error from the backend got", err)
+	}
+	if event != nil {
+		t.Fatal("Wanted nil event got", event)
+	}
+}
+
 // Make sure NotifyEvent works
 func TestFileSystemWatcherNotifyEvent(t *testing.T) {
 	// Setup the test directory
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Add the directory to the watcher
@@ -534,16 +806,10 @@ func TestFileSystemWatcherNotifyEvent(t *testing.T) {
 
 	// Setup the NotifyEvent function
 	done := make(chan struct{})
-	isdone := false
+	var once sync.Once
 	fw.NotifyEvent(func(event *Event, err error) {
-		if isdone {
-			return
-		}
 		// Make sure we send the done channel a signal at the end.
-		defer func() {
-			isdone = true
-			done <- struct{}{}
-		}()
+		defer once.Do(func() { close(done) })
 
 		if err != nil {
 			t.Error(err)
@@ -556,24 +822,134 @@ func TestFileSystemWatcherNotifyEvent(t *testing.T) {
 	})
 
 	// Actually write the file
-	ioutil.WriteFile(filepath.Join(dir, "testfile"), []byte("test"), 0700)
+	filename := filepath.Join(dir, "testfile")
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Create})
 
 	// Wait for the event to be received or we timeout
 	select {
 	case <-done:
 		return
-	case <-time.Tick(100 * time.Millisecond):
+	case <-time.After(time.Second):
 		t.Fatal("Timed out")
 	}
 }
 
+// Make sure WaitEventContext stops waiting when its context is cancelled
+func TestFileSystemWatcherWaitEventContext(t *testing.T) {
+	fw, _ := newFakeWatcher(t)
+	defer fw.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	event, err := fw.WaitEventContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("Wanted context.DeadlineExceeded got", err)
+	}
+	if event != nil {
+		t.Fatal("Wanted nil event got", event)
+	}
+}
+
+// Make sure events describe the file and the path it was added with
+func TestFileSystemWatcherEventDetails(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create|Remove, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	sub := filepath.Join(dir, "sub")
+	file := filepath.Join(sub, "test.txt")
+
+	want := []struct {
+		name  string
+		op    Op
+		isdir bool
+		info  bool
+	}{
+		{sub, Create, true, true},
+		{file, Create, false, true},
+		{file, Remove, false, false},
+	}
+	for _, w := range want {
+		// Change the file system only once the previous event has been
+		// checked, so that the file is still there for the Create.
+		switch {
+		case w.op == Create && w.isdir:
+			os.Mkdir(w.name, 0700)
+		case w.op == Create:
+			ioutil.WriteFile(w.name, []byte("test"), 0700)
+		case w.op == Remove:
+			os.Remove(w.name)
+		}
+		send(b, Event{Name: w.name, Op: w.op})
+
+		event := waitEvent(t, fw)
+		if event.Name != w.name || event.Op != w.op {
+			t.Fatalf("Wanted %s %s got %s", w.name, w.op, event)
+		}
+		if event.IsDir != w.isdir || (event.Info != nil) != w.info {
+			t.Fatalf("Wrong details for %s: IsDir %v Info %v", event, event.IsDir, event.Info)
+		}
+		if event.Root != dir {
+			t.Fatalf("Wanted root %q got %q", dir, event.Root)
+		}
+		if rel, _ := filepath.Rel(dir, w.name); event.Rel != rel {
+			t.Fatalf("Wanted rel %q got %q", rel, event.Rel)
+		}
+		if event.Time.Before(start) || event.Time.After(time.Now()) {
+			t.Fatal("Wrong time for", event, event.Time)
+		}
+	}
+}
+
+// Make sure one consumer can stop listening without closing the watcher
+func TestFileSystemWatcherNotifyEventContext(t *testing.T) {
+	// Setup the test directory
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fw, b := newFakeWatcher(t)
+	defer fw.Close()
+
+	err := fw.AddDir(dir, "", Create, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var count int64
+	stop := fw.NotifyEventContext(context.Background(), func(event *Event, err error) {
+		atomic.AddInt64(&count, 1)
+	})
+	stop()
+
+	filename := filepath.Join(dir, "testfile")
+	ioutil.WriteFile(filename, []byte("test"), 0700)
+	send(b, Event{Name: filename, Op: Create})
+
+	if event := waitEvent(t, fw); event.Name != filename {
+		t.Fatal("Got the wrong event:", event)
+	}
+	if atomic.LoadInt64(&count) != 0 {
+		t.Fatal("notify was called after stop")
+	}
+}
+
 // Make sure the watcher works with multiple events
 func TestFileSystemWatcherMultipleCreates(t *testing.T) {
 	// Setup test directory
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	// Add directory to file watcher, filtering on Create so that we only get one
@@ -593,8 +969,8 @@ func TestFileSystemWatcherMultipleCreates(t *testing.T) {
 	fw.NotifyEvent(func(event *Event, err error) {
 		// Make sure we set Done at the end.
 		defer func() {
-			wait.Done()
 			atomic.AddInt64(&counter, 1)
+			wait.Done()
 		}()
 
 		if err != nil {
@@ -617,65 +993,55 @@ func TestFileSystemWatcherMultipleCreates(t *testing.T) {
 			filename := fmt.Sprintf("%s%d.txt", "test", i)
 			filename = filepath.Join(dir, filename)
 			ioutil.WriteFile(filename, []byte("test"), 0700)
+			b.Send(filename, Create)
 		}(i)
 	}
 
 	done := make(chan struct{})
 	go func() {
 		wait.Wait()
-		c := atomic.LoadInt64(&counter)
-		if c != int64(maxCount) {
-			t.Fatalf("Wanted %d events but got %d", maxCount, c)
-		}
-		done <- struct{}{}
+		close(done)
 	}()
 
 	select {
 	case <-done:
-		return
-	case <-time.Tick(100 * time.Millisecond):
+		if c := atomic.LoadInt64(&counter); c != int64(maxCount) {
+			t.Fatalf("Wanted %d events but got %d", maxCount, c)
+		}
+	case <-time.After(time.Second):
 		t.Fatal("Timed out")
 	}
 }
 
-// Perform all file operations (taken from fsnotify tests)
-func doFileOps(t *testing.T, path string) {
-	fi, err := os.Stat(path)
-	if err != nil {
-		t.Error(err)
-	}
+// Perform all file operations (taken from fsnotify tests) on a file in dir,
+// sending b the events that fsnotify would send for each of them.
+func doFileOps(t *testing.T, b *FakeBackend, dir string) {
+	filename := filepath.Join(dir, "testfile")
 
-	filename := path
-	if fi.IsDir() {
-		filename = filepath.Join(path, "testfile")
-	}
 	// Should fire Create and Write Ops
-	var f *os.File
-	f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		t.Fatal(err)
+		// This runs in its own goroutine, so it can't stop the test.
+		t.Error(err)
+		return
 	}
-	f.Sync()
-
-	time.Sleep(5 * time.Millisecond)
+	b.Send(filename, Create)
 	f.WriteString("test")
-	f.Sync()
 	f.Close()
+	b.Send(filename, Write)
 
-	time.Sleep(5 * time.Millisecond)
 	// Should fire Chmod
 	os.Chmod(filename, 0666)
+	b.Send(filename, Chmod)
 
-	time.Sleep(5 * time.Millisecond)
-
-	// Should fire Rename
+	// Should fire Rename, and Create for the new name
 	os.Rename(filename, filename+".new")
-
-	time.Sleep(5 * time.Millisecond)
+	b.Send(filename, Rename)
+	b.Send(filename+".new", Create)
 
 	// Should fire Remove
 	os.Remove(filename + ".new")
-
+	b.Send(filename+".new", Remove)
 }
 
 // Make sure the AllOps Op filter works
@@ -684,87 +1050,22 @@ func TestOpFilterAllOps(t *testing.T) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	err := fw.AddDir(dir, "", AllOps, false)
 	if err != nil {
 		t.Error(err)
 	}
-	var wait sync.WaitGroup
-	wait.Add(5) // One for each Op
-
-	var mu sync.Mutex
-	ops := map[Op]struct{}{
-		Create: struct{}{},
-		Write:  struct{}{},
-		Remove: struct{}{},
-		Rename: struct{}{},
-		Chmod:  struct{}{},
-	}
-
-	fw.NotifyEvent(func(event *Event, err error) {
-		mu.Lock()
-		defer mu.Unlock()
-
-		if event == nil {
-			t.Fatal("event should not be nil")
-		}
-
-		if event.Op&Create == Create {
-			if _, ok := ops[Create]; !ok {
-				return
-			}
-			delete(ops, Create)
-		}
-		if event.Op&Write == Write {
-			if _, ok := ops[Write]; !ok {
-				return
-			}
-			delete(ops, Write)
-		}
-		if event.Op&Chmod == Chmod {
-			if _, ok := ops[Chmod]; !ok {
-				return
-			}
-			delete(ops, Chmod)
-		}
-		if event.Op&Rename == Rename {
-			if _, ok := ops[Rename]; !ok {
-				return
-			}
-			delete(ops, Rename)
-		}
-		if event.Op&Remove == Remove {
-			if _, ok := ops[Remove]; !ok {
-				return
-			}
-			delete(ops, Remove)
-		}
-
-		wait.Done()
-	})
-
-	done := make(chan struct{})
-	go func() {
-		wait.Wait()
-		done <- struct{}{}
-	}()
 
-	doFileOps(t, dir)
+	go doFileOps(t, b, dir)
 
-	select {
-	case <-done:
-		mu.Lock()
-		defer mu.Unlock()
-		if len(ops) > 0 {
-			t.Fatal("Did not catch all Ops:", ops)
+	// One for each Op, with the Create for the new name after the Rename.
+	want := []Op{Create, Write, Chmod, Rename, Create, Remove}
+	for _, op := range want {
+		if event := waitEvent(t, fw); event.Op != op {
+			t.Fatal("Wanted", op, "got", event)
 		}
-		return
-	case <-time.Tick(5 * time.Second):
-		mu.Lock()
-		defer mu.Unlock()
-		t.Fatal("Timed out with Ops:", ops)
 	}
 }
 
@@ -774,7 +1075,7 @@ func testOpFilter(t *testing.T, op Op) {
 	dir := makeTestDir(t)
 	defer os.RemoveAll(dir)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	err := fw.AddDir(dir, "", op, false)
@@ -782,35 +1083,36 @@ func testOpFilter(t *testing.T, op Op) {
 		t.Error(err)
 	}
 
-	fw.NotifyEvent(func(event *Event, err error) {
-
-		if event == nil {
-			t.Fatal("event should not be nil")
-		}
-
-		if err != nil {
-			t.Error(err)
-		}
+	// Once the marker is delivered, everything before it has been filtered.
+	marker := filepath.Join(dir, "marker")
+	go func() {
+		doFileOps(t, b, dir)
+		b.Send(marker, op)
+	}()
 
+	count := 0
+	for {
+		event := waitEvent(t, fw)
 		if event.Op != op {
 			t.Fatal("Notified of wrong event:", event.String())
 		}
-
-	})
-
-	doFileOps(t, dir)
-
-	time.Sleep(100 * time.Millisecond)
-
+		if event.Name == marker {
+			break
+		}
+		count++
+	}
+	if count == 0 {
+		t.Fatal("Not notified of", op)
+	}
 }
 
 // Test all the Op filters (except AllOps)
 func TestOpFilters(t *testing.T) {
 	ops := []Op{Create, Write, Rename, Remove, Chmod}
-	for i := range ops {
-		go func(i int) {
-			testOpFilter(t, ops[i])
-		}(i)
+	for _, op := range ops {
+		t.Run(op.String(), func(t *testing.T) {
+			testOpFilter(t, op)
+		})
 	}
 
 }
@@ -823,7 +1125,7 @@ func testPatternFilter(t *testing.T, pattern, fileMatch, fileNoMatch string) {
 	fileMatch = filepath.Join(dir, fileMatch)
 	fileNoMatch = filepath.Join(dir, fileNoMatch)
 
-	fw, _ := NewFileSystemWatcher()
+	fw, b := newFakeWatcher(t)
 	defer fw.Close()
 
 	err := fw.AddDir(dir, pattern, AllOps, false)
@@ -831,35 +1133,21 @@ func testPatternFilter(t *testing.T, pattern, fileMatch, fileNoMatch string) {
 		t.Error(err)
 	}
 
-	fw.NotifyEvent(func(event *Event, err error) {
-
-		if event == nil {
-			t.Fatal("event should not be nil")
-		}
-
-		if err != nil {
-			t.Error(err)
-		}
-
-		if event.Name != fileMatch {
-			t.Fatal("Notified of wrong file:", event.String())
-		}
-
-	})
-
 	err = ioutil.WriteFile(fileNoMatch, []byte("test"), 0700)
 	if err != nil {
 		t.Error(err)
 	}
 
-	time.Sleep(5 * time.Millisecond)
-
 	err = ioutil.WriteFile(fileMatch, []byte("test"), 0700)
 	if err != nil {
 		t.Error(err)
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	send(b, Event{Name: fileNoMatch, Op: Create}, Event{Name: fileMatch, Op: Create})
+
+	if event := waitEvent(t, fw); event.Name != fileMatch {
+		t.Fatal("Notified of wrong file:", event.String())
+	}
 }
 
 // Make sure file pattern filtering works
@@ -886,14 +1174,13 @@ func TestPatternFilters(t *testing.T) {
 		},
 		{
 			pattern:     "*thing.txt",
-			matching:    "somethin.txt",
+			matching:    "something.txt",
 			nonmatching: "thingsome.txt",
 		},
 	}
-	for i := range tests {
-		go func(i int) {
-			test := tests[i]
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
 			testPatternFilter(t, test.pattern, test.matching, test.nonmatching)
-		}(i)
+		})
 	}
 }